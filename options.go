@@ -0,0 +1,291 @@
+package tcpraw
+
+import (
+	"time"
+
+	"golang.org/x/net/bpf"
+)
+
+const (
+	// defaultQueueDepth is the number of captured packets which can be queued for ReadFrom
+	defaultQueueDepth = 1024
+
+	// defaultFlowTimeout is the idle time before a flow of the listener is expired
+	defaultFlowTimeout = 5 * time.Minute
+
+	// defaultSnapLen is the size of the buffer a segment is captured into
+	defaultSnapLen = 2048
+
+	// defaultReadBuffer is the receive buffer of a raw socket, about a thousand of full segments
+	defaultReadBuffer = 4 << 20
+
+	// anyInterface is the name of the pseudo-device capturing on all interfaces
+	anyInterface = "any"
+
+	// maxRetryWrites is the maximum of Options.RetryWrites
+	maxRetryWrites = 16
+)
+
+// Suppression defines how the packets of the kernel's own TCP connections are kept off the wire,
+// their ACKs would compete with the sequence numbers of the segments sent by tcpraw. The packets are
+// sent with a TTL, or hop limit, of 1, which some NICs and virtual switches ignore, and then dropped
+// by iptables rules in the OUTPUT chain. Without the rules, the packets expire at the next hop, which
+// replies ICMP Time Exceeded, except on links where the peer is the next hop, it then receives them.
+type Suppression int
+
+const (
+	SuppressIPTables Suppression = iota // TTL of 1, and the iptables rules if available, the default
+	SuppressTTL                         // TTL of 1 only, the packets expire at the next hop
+	SuppressNone                        // the kernel's packets are sent, for a path which tolerates them
+)
+
+func (s Suppression) String() string {
+	switch s {
+	case SuppressIPTables:
+		return "iptables"
+	case SuppressTTL:
+		return "ttl"
+	case SuppressNone:
+		return "none"
+	}
+	return "unknown"
+}
+
+// Options defines the tunables of a connection, the zero value is the default.
+type Options struct {
+	// QueueDepth is the number of captured packets queued before ReadFrom picks them up,
+	// packets captured while the queue is full are dropped. Default to 1024.
+	QueueDepth int
+
+	// Interface is the name of the network interface to capture and send on,
+	// instead of the one selected by the routing table. "any" captures on every interface, like
+	// the Linux "any" pseudo-device. Raw sockets see the IP layer whatever the link layer, and
+	// packets are sent on the interface of the route. Default to none.
+	Interface string
+
+	// SilentClose disables the RSTs sent to peers on Close, which tear down the peers'
+	// TCP state promptly. Default to false.
+	SilentClose bool
+
+	// RetryWrites is the number of retries on transient write errors like ENOBUFS, at
+	// most 16, with a backoff starting at 1ms and doubled on each retry up to 64ms. The
+	// sequence number only advances once a segment is sent. Default to 0, errors are
+	// returned immediately.
+	RetryWrites int
+
+	// FlowTimeout is the idle time after which a listener forgets a peer, a flow is
+	// idle when no packet is captured from the peer. WriteTo an expired peer fails.
+	// It has no effect on dialers. Default to 5 minutes.
+	FlowTimeout time.Duration
+
+	// SnapLen is the size of the buffer every raw socket captures into, a segment longer
+	// than SnapLen, TCP header and IPv4 header included, is truncated. Raw sockets wake up the reader as a
+	// segment arrives, so there is no read timeout adding latency to the capture.
+	// Default to 2048.
+	SnapLen int
+
+	// BPFFilter is a classic BPF program run on the segments to the local port, after the
+	// default port filter, so it narrows down what is captured, like excluding some hosts.
+	// The program sees IPv4 packets from the IP header, and IPv6 packets from the TCP header,
+	// and must end with return instructions. An invalid program fails the constructor with
+	// the error of the assembler or the kernel. Default to none.
+	BPFFilter []bpf.Instruction
+
+	// KeepAlive is the interval of the zero-length ACKs sent to every established peer, as the
+	// ACKs of the system TCP connection are suppressed, an idle flow could otherwise be forgotten
+	// by the NATs along the path. Default to 0, no keepalive.
+	KeepAlive time.Duration
+
+	// ReadBuffer is the size of the receive buffer of every raw socket, see SetReadBuffer.
+	// The system default of a few hundred kilobytes overflows within milliseconds of a burst
+	// on a fast link. Default to 4MB, capped by net.core.rmem_max.
+	ReadBuffer int
+
+	// Fragment lets the IP stack fragment the payloads beyond MaxPayloadSize, with the Don't
+	// Fragment flag of IPv4 cleared on every packet, instead of failing WriteTo with ErrMessageTooLong,
+	// like UDP does. Fragments are more likely dropped by middleboxes. Default to false.
+	Fragment bool
+
+	// Suppression is the way the kernel's own packets are suppressed, ListenRaw always
+	// installs its iptables rules. Default to SuppressIPTables, see TCPConn.Suppression.
+	Suppression Suppression
+
+	// ReusePort sets SO_REUSEPORT on the system TCP listener, so that several listeners bind the
+	// same port, and the kernel balances the peers among them. Every listener captures the segments
+	// of every peer, and only delivers the ones of the peers accepted by its system listener, the
+	// data arriving before the accept is dropped. It has no effect on dialers and raw listeners.
+	// Default to false.
+	ReusePort bool
+
+	// DynamicWindow scales the window advertised in the data segments and keepalives by the free
+	// space of the queue the peer's packets are delivered to, from the window of SetWindow on an
+	// empty queue down to 0 on a full one, so that the peers honoring the window slow down before
+	// packets are dropped. A segment dropped by a full queue is answered by an ACK of a zero window,
+	// like a window probe, and the window is reopened by an ACK once reads have emptied half of the
+	// queue. Default to false, the window is constant.
+	DynamicWindow bool
+
+	// SendInterface is the name of the network interface to send on, for asymmetric routing, while
+	// capturing on Interface, or the interfaces selected by the routing table. A raw socket is opened
+	// for sending on every local address captured on, bound to SendInterface, so the segments keep
+	// the source address which the peers send to, and the kernel writes the link layer of SendInterface.
+	// Default to none, the segments are sent through the capturing sockets.
+	SendInterface string
+
+	// AddressCheck is the interval to check that the local addresses captured on are still assigned
+	// to an interface, like after a DHCP renewal or a failover. A lost address is reported by an
+	// EventAddressLost to the handler of SetEventHandler, and a dialer fails with ErrAddressLost, so
+	// that the application can dial again. Linux only. Default to 0, no check.
+	AddressCheck time.Duration
+
+	// ChecksumOffload leaves the TCP checksum of the segments sent on IPv6 to the kernel, by
+	// IPV6_CHECKSUM, which hands it to the NIC on interfaces with TX checksum offload, and else
+	// computes it in software still. Raw IPv4 sockets have no such option, the checksum of IPv4
+	// segments is always computed by tcpraw. Default to false.
+	ChecksumOffload bool
+
+	// StealthMode makes the segments resemble the ones of the kernel's TCP connections on the same host,
+	// for a passive observer. The timestamps option is sent to the peers which send it, like SetTimestamps,
+	// preceded by two NOPs and followed by the options of SetTCPOptions, in the order of the kernel, and the
+	// window is advertised scaled by the window scale negotiated by the handshake. The TTL, or hop limit, is
+	// the host's default unless SetTTL is called, and the IP header, ID included, and the link layer are
+	// written by the kernel like for its own packets. It doesn't hide the behavior of the flows, like no ACK
+	// being sent for the data received and no retransmission, nor the kernel's own packets, see Suppression.
+	// Default to false.
+	StealthMode bool
+}
+
+// Dialer contains the configuration to dial many connections with, mirroring net.Dialer,
+// the zero value dials like Dial. Raw sockets need neither a promiscuous mode nor a read
+// timeout setting.
+type Dialer struct {
+	Options
+
+	// LocalAddr is the local address to dial from, like DialFrom. Default to none.
+	LocalAddr string
+
+	// TTL is the TTL, or hop limit, of the outgoing packets, see SetTTL. Default to 0, the system default.
+	TTL int
+
+	// Window is the window advertised in the outgoing segments, see SetWindow. Default to 0, 65535.
+	Window uint16
+}
+
+// ListenConfig contains the configuration to listen with, mirroring net.ListenConfig,
+// the zero value listens like Listen.
+type ListenConfig struct {
+	Options
+
+	// Raw answers the handshakes without a system TCP listener, like ListenRaw. Default to false.
+	Raw bool
+
+	// TTL is the TTL, or hop limit, of the outgoing packets, see SetTTL. Default to 0, the system default.
+	TTL int
+
+	// Window is the window advertised in the outgoing segments, see SetWindow. Default to 0, 65535.
+	Window uint16
+}
+
+func (o *Options) queueDepth() int {
+	if o == nil || o.QueueDepth <= 0 {
+		return defaultQueueDepth
+	}
+	return o.QueueDepth
+}
+
+func (o *Options) iface() string {
+	if o == nil || o.Interface == anyInterface {
+		return ""
+	}
+	return o.Interface
+}
+
+func (o *Options) silent() bool {
+	return o != nil && o.SilentClose
+}
+
+func (o *Options) retries() int {
+	if o == nil || o.RetryWrites < 0 {
+		return 0
+	}
+	if o.RetryWrites > maxRetryWrites {
+		return maxRetryWrites
+	}
+	return o.RetryWrites
+}
+
+func (o *Options) flowTimeout() time.Duration {
+	if o == nil || o.FlowTimeout <= 0 {
+		return defaultFlowTimeout
+	}
+	return o.FlowTimeout
+}
+
+func (o *Options) snapLen() int {
+	if o == nil || o.SnapLen <= 0 {
+		return defaultSnapLen
+	}
+	return o.SnapLen
+}
+
+func (o *Options) bpfFilter() []bpf.Instruction {
+	if o == nil {
+		return nil
+	}
+	return o.BPFFilter
+}
+
+func (o *Options) keepAlive() time.Duration {
+	if o == nil || o.KeepAlive < 0 {
+		return 0
+	}
+	return o.KeepAlive
+}
+
+func (o *Options) readBuffer() int {
+	if o == nil || o.ReadBuffer <= 0 {
+		return defaultReadBuffer
+	}
+	return o.ReadBuffer
+}
+
+func (o *Options) fragment() bool {
+	return o != nil && o.Fragment
+}
+
+func (o *Options) reusePort() bool {
+	return o != nil && o.ReusePort
+}
+
+func (o *Options) dynamicWindow() bool {
+	return o != nil && o.DynamicWindow
+}
+
+func (o *Options) sendIface() string {
+	if o == nil {
+		return ""
+	}
+	return o.SendInterface
+}
+
+func (o *Options) addressCheck() time.Duration {
+	if o == nil || o.AddressCheck < 0 {
+		return 0
+	}
+	return o.AddressCheck
+}
+
+func (o *Options) checksumOffload() bool {
+	return o != nil && o.ChecksumOffload
+}
+
+func (o *Options) stealthMode() bool {
+	return o != nil && o.StealthMode
+}
+
+func (o *Options) suppression() Suppression {
+	if o == nil {
+		return SuppressIPTables
+	}
+	return o.Suppression
+}
@@ -0,0 +1,187 @@
+// +build linux
+
+package tcpraw
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNotPeer = errors.New("write to an address other than the peer")
+
+// PeerConn is a connection to a single peer of a listener, it implements net.Conn,
+// and the packet-oriented ReadFrom/WriteTo scoped to the peer.
+type PeerConn struct {
+	conn  *TCPConn
+	raddr *net.TCPAddr
+
+	chMessage chan message
+
+	die     chan struct{}
+	dieOnce sync.Once
+	err     error // the error after die, instead of io.EOF
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newPeerConn(conn *TCPConn, raddr *net.TCPAddr) *PeerConn {
+	pc := new(PeerConn)
+	pc.conn = conn
+	pc.raddr = &net.TCPAddr{IP: raddr.IP, Port: raddr.Port, Zone: raddr.Zone}
+	pc.chMessage = make(chan message, cap(conn.chMessage))
+	pc.die = make(chan struct{})
+	pc.readDeadline = makeDeadline()
+	pc.writeDeadline = makeDeadline()
+	return pc
+}
+
+// Accept waits for the next peer sending data to the listener, and returns the connection to it.
+// After the first Accept, captured packets are delivered to the accepted connections instead of
+// ReadFrom of the listener, and a new peer is dropped while the backlog of 128 peers is full.
+func (conn *TCPConn) Accept() (net.Conn, error) {
+	pc, err := conn.AcceptPeer()
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// AcceptPeer is like Accept, but returns a *PeerConn.
+func (conn *TCPConn) AcceptPeer() (*PeerConn, error) {
+	if conn.chAccept == nil {
+		return nil, errNotListener
+	}
+	atomic.StoreInt32(&conn.accepting, 1)
+	select {
+	case pc := <-conn.chAccept:
+		return pc, nil
+	case <-conn.die:
+		return nil, conn.closedErr()
+	}
+}
+
+// Addr returns the listening address, with Accept it implements net.Listener.
+func (conn *TCPConn) Addr() net.Addr { return conn.LocalAddr() }
+
+// Read implements the Conn Read method.
+func (pc *PeerConn) Read(p []byte) (n int, err error) {
+	n, _, err = pc.ReadFrom(p)
+	return
+}
+
+// ReadFrom reads a packet of the peer, like ReadFrom of the listener.
+func (pc *PeerConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case <-pc.readDeadline.wait():
+		return 0, nil, errTimeout
+	case <-pc.die:
+		// the data queued before the peer finished is still delivered
+		select {
+		case packet := <-pc.chMessage:
+			return pc.deliver(p, packet)
+		default:
+		}
+		return 0, nil, pc.closedErr()
+	case <-pc.conn.die:
+		return 0, nil, pc.conn.closedErr()
+	case packet := <-pc.chMessage:
+		return pc.deliver(p, packet)
+	}
+}
+
+// deliver copies a packet into p, like ReadFrom of the listener
+func (pc *PeerConn) deliver(p []byte, packet message) (n int, addr net.Addr, err error) {
+	n = copy(p, packet.bts)
+	pc.conn.putPayload(packet.buf)
+	pc.conn.reopenWindow(pc.chMessage)
+	if n < len(packet.bts) && atomic.LoadInt32(&pc.conn.strictRead) != 0 {
+		return n, packet.addr, io.ErrShortBuffer
+	}
+	return n, packet.addr, nil
+}
+
+// Write implements the Conn Write method.
+func (pc *PeerConn) Write(p []byte) (n int, err error) {
+	select {
+	case <-pc.die:
+		return 0, pc.closedErr()
+	default:
+		return pc.conn.writeTo(p, pc.raddr, FlagPSH|FlagACK, 0, pc.writeDeadline.wait())
+	}
+}
+
+// WriteTo writes a packet to the peer, addr must be the address of the peer.
+func (pc *PeerConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if key, ok := flowKeyOf(addr); !ok || key != newFlowKey(pc.raddr) {
+		return 0, errNotPeer
+	}
+	return pc.Write(p)
+}
+
+// CloseWrite sends a FIN to the peer, like CloseWrite of net.TCPConn, Read keeps receiving.
+func (pc *PeerConn) CloseWrite() error {
+	return pc.conn.CloseWriteTo(pc.raddr)
+}
+
+// Close closes the connection to the peer, the listener is left open,
+// and the next packet from the peer is accepted as a new connection.
+func (pc *PeerConn) Close() error {
+	pc.shutdown()
+	pc.conn.updateflow(pc.raddr, func(e *tcpFlow) {
+		if e.peer == pc {
+			e.peer = nil
+		}
+	})
+	return nil
+}
+
+// shutdown stops the reads and writes of the connection
+func (pc *PeerConn) shutdown() {
+	pc.shutdownWith(nil)
+}
+
+// shutdownWith stops the reads and writes of the connection, which return err instead of io.EOF if not nil
+func (pc *PeerConn) shutdownWith(err error) {
+	pc.dieOnce.Do(func() {
+		pc.err = err
+		close(pc.die)
+	})
+}
+
+// closedErr returns the error of the operations on a stopped connection
+func (pc *PeerConn) closedErr() error {
+	if pc.err != nil {
+		return pc.err
+	}
+	return io.EOF
+}
+
+// LocalAddr returns the local network address.
+func (pc *PeerConn) LocalAddr() net.Addr { return pc.conn.LocalAddr() }
+
+// RemoteAddr returns the address of the peer.
+func (pc *PeerConn) RemoteAddr() net.Addr { return pc.raddr }
+
+// SetDeadline implements the Conn SetDeadline method.
+func (pc *PeerConn) SetDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (pc *PeerConn) SetReadDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method.
+func (pc *PeerConn) SetWriteDeadline(t time.Time) error {
+	pc.writeDeadline.set(t)
+	return nil
+}
@@ -3,64 +3,464 @@
 package tcpraw
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/bits"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
 )
 
 var (
 	errOpNotImplemented = errors.New("operation not implemented")
-	errTimeout          = errors.New("timeout")
-	expire              = time.Minute
+	errTimeout          = timeoutError{}
+	errNoPort           = errors.New("raw listener requires an explicit port")
+	errNotRawSocket     = errors.New("file descriptor is not a raw IP socket")
+	errUnbound          = errors.New("raw socket must be bound to a local address")
+	errNoHandle         = errors.New("raw socket is nil")
+	errInvalidTTL       = errors.New("TTL out of range [1, 255]")
+	errInvalidFlowLabel = errors.New("flow label out of range [0, 0xfffff]")
+	errInvalidDSCP      = errors.New("DSCP out of range [0, 63]")
+	errInvalidUrgent    = errors.New("urgent pointer out of the payload")
+	errNotListener      = errors.New("accept on a dialed connection")
+	errNoPrivilege      = errors.New("raw sockets need root or CAP_NET_RAW")
+	errNoRawSupport     = errors.New("raw sockets are not supported by the kernel")
+	errNoSuppression    = errors.New("raw listener requires iptables to suppress kernel RST")
+	errTCPOptions       = errors.New("TCP options exceed 40 bytes")
+	errNotDialer        = errors.New("close write on a listener, use CloseWriteTo")
+	errWriteClosed      = errors.New("write to a flow closed by CloseWrite")
+	errNoTarget         = errors.New("target without host")
+	retryBackoff        = time.Millisecond // initial backoff of write retries, doubled on each retry
+	synExpire           = 30 * time.Second // half-open flows timeout in raw mode
+)
+
+// ErrWouldBlock is returned by ReadFromNonblock when no packet is queued, it implements net.Error
+// with Temporary true.
+var ErrWouldBlock net.Error = wouldBlockError{}
+
+// ErrAddressLost is the error of a dialer whose local address is no longer assigned, see Options.AddressCheck
+var ErrAddressLost = errors.New("local address is no longer assigned")
+
+// ErrMessageTooLong is returned by writes of a payload beyond MaxPayloadSize, like EMSGSIZE of UDP
+var ErrMessageTooLong = errors.New("message too long")
+
+const (
+	maxHalfOpen   = 1024  // maximum half-open flows in raw mode
+	maxAhead      = 16    // maximum segments beyond a gap remembered per flow
+	acceptBacklog = 128   // maximum peers waiting for Accept
+	defaultWindow = 65535 // advertised window of outgoing segments
+
+	maxWindowScale = 14 // maximum shift of the window scale option, RFC 7323
+
+	maxRetryBackoff = 64 * time.Millisecond  // backoff of write retries stops doubling there
+	windowProbe     = 200 * time.Millisecond // initial interval of the zero window probes, doubled on each probe
+	maxWindowProbe  = time.Minute            // interval of the zero window probes stops doubling there
 )
 
 // a message from NIC
 type message struct {
 	bts  []byte
 	addr net.Addr
+	hdr  []byte  // the raw TCP header, following bts in buf, decoded by ReadFromTCP only
+	buf  *[]byte // the pooled buffer of bts, recycled once bts is copied out
+}
+
+// TCPFlags defines the control bits of a TCP header
+type TCPFlags uint16
+
+const (
+	FlagFIN TCPFlags = 1 << iota
+	FlagSYN
+	FlagRST
+	FlagPSH
+	FlagACK
+	FlagURG
+	FlagECE
+	FlagCWR
+	FlagNS
+)
+
+// TCPHeader defines the fields of the TCP header of a captured segment, see ReadFromTCP
+type TCPHeader struct {
+	Seq     uint32
+	Ack     uint32
+	Window  uint16
+	Flags   TCPFlags
+	Urgent  uint16             // the urgent pointer, meaningful with FlagURG only
+	Options []layers.TCPOption // nil if none, the option data is a copy
+}
+
+// apply sets the flags of a TCP header to f
+func (f TCPFlags) apply(tcp *layers.TCP) {
+	tcp.FIN = f&FlagFIN != 0
+	tcp.SYN = f&FlagSYN != 0
+	tcp.RST = f&FlagRST != 0
+	tcp.PSH = f&FlagPSH != 0
+	tcp.ACK = f&FlagACK != 0
+	tcp.URG = f&FlagURG != 0
+	tcp.ECE = f&FlagECE != 0
+	tcp.CWR = f&FlagCWR != 0
+	tcp.NS = f&FlagNS != 0
+}
+
+// headerOf decodes the raw TCP header of a queued segment, which has been decoded once when captured
+func headerOf(raw []byte) TCPHeader {
+	var tcp layers.TCP
+	if err := tcp.DecodeFromBytes(raw, gopacket.NilDecodeFeedback); err != nil {
+		return TCPHeader{}
+	}
+	return tcpHeaderOf(&tcp)
+}
+
+// tcpHeaderOf copies the header fields of a decoded segment
+func tcpHeaderOf(tcp *layers.TCP) TCPHeader {
+	hdr := TCPHeader{Seq: tcp.Seq, Ack: tcp.Ack, Window: tcp.Window, Urgent: tcp.Urgent}
+	for k, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR, tcp.NS} {
+		if set {
+			hdr.Flags |= 1 << uint(k)
+		}
+	}
+	if len(tcp.Options) > 0 {
+		hdr.Options = make([]layers.TCPOption, len(tcp.Options))
+		for k, o := range tcp.Options {
+			hdr.Options[k] = o
+			hdr.Options[k].OptionData = append([]byte(nil), o.OptionData...)
+		}
+	}
+	return hdr
+}
+
+// a captured segment held until the system listener accepts its connection
+type heldSegment struct {
+	handle  *net.IPConn
+	segment []byte
+	from    *net.IPAddr
+}
+
+// serializePool holds the buffers for serializing outgoing segments
+var serializePool = sync.Pool{
+	New: func() interface{} { return gopacket.NewSerializeBuffer() },
 }
 
 // a tcp flow information of a connection pair
 type tcpFlow struct {
-	conn         *net.TCPConn               // the related system TCP connection of this flow
-	handle       *net.IPConn                // the handle to send packets
-	seq          uint32                     // TCP sequence number
-	ack          uint32                     // TCP acknowledge number
-	networkLayer gopacket.SerializableLayer // network layer header for tx
-	ts           time.Time                  // last packet incoming time
-	buf          gopacket.SerializeBuffer   // a buffer for write
+	conn         *net.TCPConn          // the related system TCP connection of this flow
+	handshaked   bool                  // the flow is established by a raw handshake
+	synSeen      bool                  // the SYN to the system listener is captured
+	held         []heldSegment         // the segments after synSeen, until the system listener accepts
+	handle       *net.IPConn           // the handle to send packets
+	ready        chan struct{}         // closed once the handle is known
+	peer         *PeerConn             // the accepted connection of the flow
+	seq          uint32                // TCP sequence number
+	seqKnown     bool                  // seq has been learnt from the handshake
+	ack          uint32                // TCP acknowledge number
+	ackKnown     bool                  // ack has been learnt from the SYN of the peer, or its first data
+	ahead        []seqRange            // segments received beyond a gap after ack
+	networkLayer gopacket.NetworkLayer // network layer header for the checksum of tx
+	ts           time.Time             // last packet incoming time
 	tcpHeader    layers.TCP
+
+	// TCP timestamps
+	tsRecent  uint32        // latest TSval from peer
+	tsEcho    uint32        // latest TSecr from peer before we send timestamps, the clock we continue
+	tsClock   time.Time     // the time tsEcho was captured
+	tsReady   bool          // tsEcho is valid
+	tsFirst   uint32        // the first TSval we sent, echoes before it are not ours
+	tsSending bool          // we have sent timestamps
+	tsOpt     [8]byte       // option data for tx
+	rtt       time.Duration // latest RTT sample
+
+	windowClosed bool // a zero window is advertised, as the queue of the flow is full
+	finSent      bool // our FIN is sent, the flow takes no more writes
+
+	// flow control by the window of the peer
+	peerWindow uint32        // the window of the latest ACK from the peer, scaled
+	peerScale  uint8         // the window scale of the peer, negotiated by the handshake
+	localScale uint8         // our window scale, negotiated by the handshake, applied in stealth mode
+	peerClosed chan struct{} // closed once the zero window of the peer reopens, nil while it's open
+}
+
+// a range of sequence numbers [start, end)
+type seqRange struct {
+	start, end uint32
+}
+
+// a half-open flow in raw mode, waiting for the final ACK of the handshake
+type halfOpenFlow struct {
+	isn       uint32    // our initial sequence number
+	peerISN   uint32    // initial sequence number from SYN
+	peerScale uint8     // the window scale of SYN, echoed by the SYN-ACK
+	ts        time.Time // last SYN incoming time
+}
+
+// FlowInfo defines the tracked state of a flow, see Flows
+type FlowInfo struct {
+	Addr *net.TCPAddr // the remote address
+	Seq  uint32       // the sequence number of the next segment sent
+	Ack  uint32       // the acknowledge number sent, the next sequence number expected
+
+	Window uint32 // the window of the latest ACK from the peer in bytes, see PeerWindow
+}
+
+// Stats defines the packet and byte counters of a connection
+type Stats struct {
+	ReadPackets    uint64 // packets captured and queued for reading
+	ReadBytes      uint64 // payload bytes captured and queued for reading
+	WritePackets   uint64 // packets sent
+	WriteBytes     uint64 // payload bytes sent
+	ReadDropped    uint64 // packets captured but dropped for the reader isn't keeping up, or beyond too many out of order
+	ReadInvalid    uint64 // packets captured but discarded for not being valid TCP segments
+	ReadDuplicated uint64 // packets captured but discarded as retransmissions of delivered data
+}
+
+// EventType defines the kind of an Event
+type EventType int
+
+const (
+	EventRead         EventType = iota // a packet is captured and queued for reading
+	EventWrite                         // a packet is sent
+	EventDrop                          // a packet is captured but dropped for the reader isn't keeping up
+	EventFlowCreated                   // a packet is captured from a new remote address
+	EventFlowExpired                   // a flow of the listener has been idle for Options.FlowTimeout
+	EventCaptureError                  // the capture has failed, or the peer has reset a dialer, and the connection is closed
+	EventAddressLost                   // a local address captured on is no longer assigned, see Options.AddressCheck
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventRead:
+		return "read"
+	case EventWrite:
+		return "write"
+	case EventDrop:
+		return "drop"
+	case EventFlowCreated:
+		return "flow created"
+	case EventFlowExpired:
+		return "flow expired"
+	case EventCaptureError:
+		return "capture error"
+	case EventAddressLost:
+		return "address lost"
+	}
+	return "unknown"
+}
+
+// Event defines an event of a connection, see SetEventHandler
+type Event struct {
+	Type  EventType
+	Addr  net.Addr // the remote address, the local one for EventAddressLost, nil for EventCaptureError
+	Bytes int      // the payload size of EventRead, EventWrite and EventDrop
+	Err   error    // the error of EventCaptureError
+}
+
+// an event handler, stored in atomic.Value with a consistent type even if nil
+type eventHandler func(Event)
+
+// the levels of the messages passed to the logger of SetLogger
+const (
+	LogDebug = "debug" // the decisions on every segment, like a segment sent
+	LogInfo  = "info"  // the changes of a flow, like a flow reset or finished by the peer
+	LogWarn  = "warn"  // the losses, like a packet dropped by a full queue
+	LogError = "error" // the failures which close the connection
+)
+
+// a logger, stored in atomic.Value with a consistent type even if nil
+type logFunc func(level, msg string, kv ...interface{})
+
+// timingBuckets is the number of buckets of a TimingHistogram, up to about 1 second
+const timingBuckets = 31
+
+// TimingHistogram defines the distribution of the time spent on the segments, see SerializeTiming.
+// Buckets[0] counts the segments taking less than 1ns, then Buckets[k] counts the ones taking
+// [2^(k-1), 2^k) nanoseconds, the last bucket counts the longer ones as well.
+type TimingHistogram struct {
+	Buckets [timingBuckets]uint64
+	Count   uint64        // the segments counted
+	Total   time.Duration // the time spent on all the segments
+}
+
+// Mean returns the average time spent on a segment, or 0 without segments counted.
+func (h TimingHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+// SocketStats defines the counters of the raw sockets which capture for a connection
+type SocketStats struct {
+	Received uint64 // segments received from the raw sockets
+	Dropped  uint64 // segments dropped by the kernel as the receive buffers are full
+}
+
+// LinkType defines the link layer of the interface a connection is carried on
+type LinkType int
+
+const (
+	LinkUnknown  LinkType = iota // not found, or differing among the interfaces of a listener
+	LinkEthernet                 // Ethernet, or a link with 6-byte hardware addresses
+	LinkLoopback                 // the loopback interface
+	LinkRaw                      // a link without hardware addresses, like tunnels and PPP, carrying IP packets bare
+)
+
+func (t LinkType) String() string {
+	switch t {
+	case LinkEthernet:
+		return "ethernet"
+	case LinkLoopback:
+		return "loopback"
+	case LinkRaw:
+		return "raw"
+	}
+	return "unknown"
+}
+
+// InterfaceInfo defines a network interface which might carry a connection, see Interfaces
+type InterfaceInfo struct {
+	Name     string
+	Addrs    []*net.IPNet // the addresses of the family of the target
+	LinkType LinkType
+	Routed   bool // the interface is selected by the routing table for the target
+}
+
+// InterfaceNotFoundError is returned when the interface of Options.Interface doesn't exist, or
+// no interface has an address of the family of the network to capture on.
+type InterfaceNotFoundError struct {
+	Network   string          // the network captured, "tcp", "tcp4" or "tcp6"
+	Addr      net.IP          // the remote address of a dialer, the address of a listener, nil or unspecified for all
+	Interface string          // the name of Options.Interface, empty for all the interfaces
+	Scanned   []InterfaceInfo // the interfaces scanned, with the addresses of every family
+}
+
+func (e *InterfaceNotFoundError) Error() string {
+	found := false
+	for _, info := range e.Scanned {
+		found = found || info.Name == e.Interface
+	}
+	var b strings.Builder
+	if e.Interface != "" && !found {
+		fmt.Fprintf(&b, "interface %v not found", e.Interface)
+	} else {
+		fmt.Fprintf(&b, "no interface with an address of %v to capture on for %v", e.Network, e.Addr)
+	}
+	b.WriteString(", scanned")
+	for _, info := range e.Scanned {
+		fmt.Fprintf(&b, " %v%v", info.Name, info.Addrs)
+	}
+	if e.Interface == "" && (e.Addr == nil || e.Addr.IsUnspecified()) {
+		b.WriteString(", the wildcard address captures on the addresses of the family of the network only")
+	}
+	return b.String()
+}
+
+// scanInterfaces returns the interfaces with the addresses of every family
+func scanInterfaces(ifaces []net.Interface) []InterfaceInfo {
+	infos := make([]InterfaceInfo, 0, len(ifaces))
+	for k := range ifaces {
+		info := InterfaceInfo{Name: ifaces[k].Name, LinkType: linkTypeOf(&ifaces[k])}
+		if addrs, err := ifaces[k].Addrs(); err == nil {
+			for _, addr := range addrs {
+				if ipnet, ok := addr.(*net.IPNet); ok {
+					info.Addrs = append(info.Addrs, ipnet)
+				}
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
 }
 
 // TCPConn defines a TCP-packet oriented connection
 type TCPConn struct {
+	stats    Stats  // first field for 64-bit alignment of atomic operations
+	received uint64 // segments received from the raw sockets
+	dropped  uint64 // segments dropped by the kernel
+	srtt     int64  // smoothed RTT in nanoseconds
+
+	serializeTiming [timingBuckets]uint64 // segments serialized by the bucket of the time spent, see SerializeTiming
+	serializeTotal  int64                 // nanoseconds spent serializing
+
+	peerWindow uint32 // the window of the latest ACK captured from any peer
+
 	die     chan struct{}
 	dieOnce sync.Once
+	wg      sync.WaitGroup // goroutines of the connection, joined by CloseWithTimeout
+
+	// the handler of events, of eventHandler
+	handler atomic.Value
+
+	// the logger of SetLogger, of logFunc
+	logger atomic.Value
+
+	// the error which failed the capture
+	errLock sync.Mutex
+	lastErr error
 
 	// the main golang sockets
 	tcpconn  *net.TCPConn     // from net.Dial
 	listener *net.TCPListener // from net.Listen
+	laddr    *net.TCPAddr     // listening address
+
+	// raw mode, handshakes are answered by ourselves instead of kernel
+	raw      bool
+	synTable map[flowKey]*halfOpenFlow
+
+	// the port is shared with other listeners, which capture the same segments
+	reusePort bool
 
 	// handles
 	handles []*net.IPConn
 
+	// the handle sending the segments of the flows captured on a handle, bound to Options.SendInterface
+	sendHandles map[*net.IPConn]*net.IPConn
+
+	// MTU of the interface of each handle, 0 for unknown
+	mtu map[*net.IPConn]int
+
+	// payloads beyond the MTU are fragmented instead of rejected
+	fragment bool
+
+	// the TCP checksum of IPv6 segments is computed by the kernel
+	checksumOffload bool
+
+	// the advertised window is scaled by the free space of the read queues
+	dynamicWindow bool
+	windowClosed  int32 // a flow has a zero window advertised, to be reopened by the reads
+
+	// the segments mimic the ones of the kernel's stack, see Options.StealthMode
+	stealth bool
+
+	// the buffers of the queued payloads, of *[]byte
+	payloads sync.Pool
+
 	// packets captured from all related NICs will be delivered to this channel
 	chMessage chan message
 
+	// per-peer connections waiting for Accept
+	chAccept  chan *PeerConn
+	accepting int32
+
 	// all TCP flows
-	flowTable map[string]*tcpFlow
+	flowTable map[flowKey]*tcpFlow
 	flowsLock sync.Mutex
 
 	// iptables
@@ -70,500 +470,3069 @@ type TCPConn struct {
 	ip6tables *iptables.IPTables
 	ip6rule   []string
 
+	// the effective suppression of the kernel's own packets
+	suppression Suppression
+
 	// deadlines
-	readDeadline  atomic.Value
-	writeDeadline atomic.Value
+	readDeadline  deadline
+	writeDeadline deadline
+
+	// report truncated reads
+	strictRead int32
+
+	// send TCP timestamps
+	timestamps int32
+
+	// the number of Replay calls running, nothing is sent meanwhile
+	replaying int32
+
+	// advertised window
+	window uint32
+
+	// IPv6 flow label of outgoing packets, 0 for none
+	flowLabel uint32
+
+	// TCP options of outgoing packets and their length, guarded by flowsLock
+	tcpOptions    []layers.TCPOption
+	tcpOptionsLen int
 
 	// serialization
 	opts gopacket.SerializeOptions
+
+	// close without RST to peers
+	silentClose bool
+
+	// retries on transient write errors
+	retryWrites int
+
+	// idle time before a flow of the listener is expired
+	flowTimeout time.Duration
+
+	// capture buffer size
+	snapLen int
+
+	// interval of keepalive ACKs, 0 for none
+	keepAlive time.Duration
+
+	// socket filter
+	filterLock sync.Mutex
+}
+
+// flowKey identifies a flow by the remote address, IPv4 addresses are kept in the IPv4-mapped
+// IPv6 form, so every representation of a peer's address maps to the same flow. A link-local
+// address is qualified by its zone, the same address may be used by peers on different links.
+type flowKey struct {
+	ip   [16]byte
+	zone string
+	port int
+}
+
+func newFlowKey(addr *net.TCPAddr) (key flowKey) {
+	copy(key.ip[:], addr.IP.To16())
+	if addr.IP.IsLinkLocalUnicast() {
+		key.zone = addr.Zone
+	}
+	key.port = addr.Port
+	return
+}
+
+// flowKeyOf returns the key of addr, an address other than *net.TCPAddr is resolved from its string form,
+// ok is false if it doesn't resolve
+func flowKeyOf(addr net.Addr) (key flowKey, ok bool) {
+	if tcpaddr, ok := addr.(*net.TCPAddr); ok {
+		return newFlowKey(tcpaddr), true
+	}
+	if tcpaddr, err := net.ResolveTCPAddr("tcp", addr.String()); err == nil {
+		return newFlowKey(tcpaddr), true
+	}
+	return flowKey{}, false
+}
+
+// addr returns the remote address of the flow
+func (key flowKey) addr() *net.TCPAddr {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, key.ip[:])
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.TCPAddr{IP: ip, Port: key.port, Zone: key.zone}
 }
 
-// lockflow locks the flow table and apply function `f` to the entry, and create one if not exist
+// lockflow locks the flow table and apply function `f` to the entry, and create one if not exist,
+// nothing is done for an addr which doesn't resolve
 func (conn *TCPConn) lockflow(addr net.Addr, f func(e *tcpFlow)) {
-	key := addr.String()
+	key, ok := flowKeyOf(addr)
+	if !ok {
+		return
+	}
 	conn.flowsLock.Lock()
 	e := conn.flowTable[key]
-	if e == nil { // entry first visit
+	created := e == nil
+	if created { // entry first visit
 		e = new(tcpFlow)
 		e.ts = time.Now()
-		e.buf = gopacket.NewSerializeBuffer()
+		e.ready = make(chan struct{})
 	}
 	f(e)
 	conn.flowTable[key] = e
 	conn.flowsLock.Unlock()
-}
-
-// clean expired flows
-func (conn *TCPConn) cleaner() {
-	ticker := time.NewTicker(time.Minute)
-	select {
-	case <-conn.die:
-		return
-	case <-ticker.C:
-		conn.flowsLock.Lock()
-		for k, v := range conn.flowTable {
-			if time.Now().Sub(v.ts) > expire {
-				if v.conn != nil {
-					setTTL(v.conn, 64)
-					v.conn.Close()
-				}
-				delete(conn.flowTable, k)
-			}
+	if created {
+		conn.emit(Event{Type: EventFlowCreated, Addr: key.addr()})
+		if log := conn.log(); log != nil {
+			log(LogDebug, "flow created", "addr", key.addr())
 		}
-		conn.flowsLock.Unlock()
 	}
 }
 
-// captureFlow capture every inbound packets based on rules of BPF
-func (conn *TCPConn) captureFlow(handle *net.IPConn, port int) {
-	buf := make([]byte, 2048)
-	opt := gopacket.DecodeOptions{NoCopy: true, Lazy: true}
-	for {
-		n, addr, err := handle.ReadFromIP(buf)
-		if err != nil {
-			return
-		}
-
-		// try decoding TCP frame from buf[:n]
-		packet := gopacket.NewPacket(buf[:n], layers.LayerTypeTCP, opt)
-		transport := packet.TransportLayer()
-		tcp, ok := transport.(*layers.TCP)
-		if !ok {
-			continue
-		}
+// errNoFlow is returned for writing to a peer which is unknown or expired
+func errNoFlow(addr net.Addr) error {
+	return fmt.Errorf("no established flow for %v", addr)
+}
 
-		// port filtering
-		if int(tcp.DstPort) != port {
-			continue
-		}
+// updateflow locks the flow table and apply function `f` to the entry, returns false if not exist
+func (conn *TCPConn) updateflow(addr net.Addr, f func(e *tcpFlow)) bool {
+	key, ok := flowKeyOf(addr)
+	if !ok {
+		return false
+	}
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	e := conn.flowTable[key]
+	if e == nil {
+		return false
+	}
+	f(e)
+	return true
+}
 
-		// address building
-		var src net.TCPAddr
-		src.IP = addr.IP
-		src.Port = int(tcp.SrcPort)
+// lookupFlow returns the entry of the flow without creating one
+func (conn *TCPConn) lookupFlow(addr net.Addr) *tcpFlow {
+	key, ok := flowKeyOf(addr)
+	if !ok {
+		return nil
+	}
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	return conn.flowTable[key]
+}
 
-		var orphan bool
-		// flow maintaince
-		conn.lockflow(&src, func(e *tcpFlow) {
-			if e.conn == nil { // make sure it's related to net.TCPConn
-				orphan = true // mark as orphan if it's not related net.TCPConn
-			}
+// removeflow deletes a flow of the listener, and closes its accepted connection and system
+// TCP connection, the caller must hold flowsLock.
+func (conn *TCPConn) removeflow(key flowKey, e *tcpFlow) {
+	e.openPeerWindow() // writers waiting for the window find the flow gone
+	if e.peer != nil {
+		e.peer.shutdown()
+	}
+	if e.conn != nil {
+		setTTL(e.conn, 64)
+		e.conn.Close()
+	}
+	delete(conn.flowTable, key)
+}
 
-			// to keep track of TCP header related to this source
-			e.ts = time.Now()
-			if tcp.ACK {
-				e.seq = tcp.Ack
-			}
-			if tcp.SYN {
-				e.ack = tcp.Seq + 1
+// clean flows of the listener which have been idle for flowTimeout, and the half-open flows of raw mode
+func (conn *TCPConn) cleaner() {
+	defer conn.wg.Done()
+	interval := conn.flowTimeout / 2
+	if conn.synTable != nil && interval > synExpire/2 {
+		interval = synExpire / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
+			var expired []flowKey
+			conn.flowsLock.Lock()
+			for k, v := range conn.flowTable {
+				if time.Now().Sub(v.ts) > conn.flowTimeout {
+					conn.removeflow(k, v)
+					expired = append(expired, k)
+				}
 			}
-			if tcp.PSH {
-				if e.ack == tcp.Seq {
-					e.ack = tcp.Seq + uint32(len(tcp.Payload))
+			for k, v := range conn.synTable {
+				if time.Now().Sub(v.ts) > synExpire {
+					delete(conn.synTable, k)
 				}
 			}
-			e.handle = handle
-		})
-
-		// push data if it's not orphan
-		if !orphan && tcp.PSH {
-			payload := make([]byte, len(tcp.Payload))
-			copy(payload, tcp.Payload)
-			select {
-			case conn.chMessage <- message{payload, &src}:
-			case <-conn.die:
-				return
+			conn.flowsLock.Unlock()
+			for _, k := range expired {
+				conn.emit(Event{Type: EventFlowExpired, Addr: k.addr()})
+				if log := conn.log(); log != nil {
+					log(LogInfo, "flow expired", "addr", k.addr())
+				}
 			}
 		}
 	}
 }
 
-// ReadFrom implements the PacketConn ReadFrom method.
-func (conn *TCPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	var timer *time.Timer
-	var deadline <-chan time.Time
-	if d, ok := conn.readDeadline.Load().(time.Time); ok && !d.IsZero() {
-		timer = time.NewTimer(time.Until(d))
-		defer timer.Stop()
-		deadline = timer.C
-	}
-
-	select {
-	case <-deadline:
-		return 0, nil, errTimeout
-	case <-conn.die:
-		return 0, nil, io.EOF
-	case packet := <-conn.chMessage:
-		n = copy(p, packet.bts)
-		return n, packet.addr, nil
-	}
+// discard reads everything from the system TCP connection until it's closed, or finished by the peer,
+// then closes it
+func (conn *TCPConn) discard(tcpconn *net.TCPConn) {
+	defer conn.wg.Done()
+	io.Copy(ioutil.Discard, tcpconn)
+	tcpconn.Close()
 }
 
-// WriteTo implements the PacketConn WriteTo method.
-func (conn *TCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	var deadline <-chan time.Time
-	if d, ok := conn.writeDeadline.Load().(time.Time); ok && !d.IsZero() {
-		timer := time.NewTimer(time.Until(d))
-		defer timer.Stop()
-		deadline = timer.C
-	}
-
+// fail records the error which stopped a capture before Close, and closes the connection,
+// so that blocked reads and writes return the error instead of waiting forever
+func (conn *TCPConn) fail(err error) {
+	conn.errLock.Lock()
 	select {
-	case <-deadline:
-		return 0, errTimeout
-	case <-conn.die:
-		return 0, io.EOF
+	case <-conn.die: // handles closed by Close
+		conn.errLock.Unlock()
+		return
 	default:
-		raddr, err := net.ResolveTCPAddr("tcp", addr.String())
-		if err != nil {
-			return 0, err
-		}
+	}
+	if conn.lastErr == nil {
+		conn.lastErr = err
+	}
+	conn.errLock.Unlock()
+	conn.emit(Event{Type: EventCaptureError, Err: err})
+	if log := conn.log(); log != nil {
+		log(LogError, "connection failed", "err", err)
+	}
+	conn.Close()
+}
 
-		var lport int
-		if conn.tcpconn != nil {
-			lport = conn.tcpconn.LocalAddr().(*net.TCPAddr).Port
+// abort releases what a failed dial or listen has opened, after stopping the goroutines started,
+// the handles of the caller are left open if keep, with the read deadline cleared and the filter detached
+func (conn *TCPConn) abort(keep bool) {
+	conn.dieOnce.Do(func() { close(conn.die) })
+	for _, handle := range conn.handles {
+		if keep {
+			handle.SetReadDeadline(time.Now()) // wake up the capture
 		} else {
-			lport = conn.listener.Addr().(*net.TCPAddr).Port
+			handle.Close()
 		}
+	}
+	for _, handle := range conn.sendHandles {
+		handle.Close()
+	}
+	if conn.listener != nil {
+		conn.listener.Close()
+	}
+	if conn.tcpconn != nil {
+		conn.tcpconn.Close()
+	}
+	conn.wg.Wait()
+	if keep {
+		for _, handle := range conn.handles {
+			handle.SetReadDeadline(time.Time{})
+			setBPF(handle, nil)
+		}
+	}
+}
 
-		conn.lockflow(addr, func(e *tcpFlow) {
-			// if the flow doesn't have handle , assume this packet has lost, without notification
-			if e.handle == nil {
-				n = len(p)
-				return
-			}
-
-			// build tcp header with local and remote port
-			e.tcpHeader.SrcPort = layers.TCPPort(lport)
-			e.tcpHeader.DstPort = layers.TCPPort(raddr.Port)
-			binary.Read(rand.Reader, binary.LittleEndian, &e.tcpHeader.Window)
-			e.tcpHeader.Window |= 0x8000 // make sure it's larger than 32768
-			e.tcpHeader.Ack = e.ack
-			e.tcpHeader.Seq = e.seq
-			e.tcpHeader.PSH = true
-			e.tcpHeader.ACK = true
-
-			// build IP header with src & dst ip for TCP checksum
-			if raddr.IP.To4() != nil {
-				ip := &layers.IPv4{
-					Protocol: layers.IPProtocolTCP,
-					SrcIP:    e.handle.LocalAddr().(*net.IPAddr).IP.To4(),
-					DstIP:    raddr.IP.To4(),
-				}
-				e.tcpHeader.SetNetworkLayerForChecksum(ip)
-			} else {
-				ip := &layers.IPv6{
-					NextHeader: layers.IPProtocolTCP,
-					SrcIP:      e.handle.LocalAddr().(*net.IPAddr).IP.To16(),
-					DstIP:      raddr.IP.To16(),
-				}
-				e.tcpHeader.SetNetworkLayerForChecksum(ip)
-			}
+// LastError returns the error which stopped capturing and closed the connection,
+// or nil if the connection is open or closed by Close.
+func (conn *TCPConn) LastError() error {
+	conn.errLock.Lock()
+	defer conn.errLock.Unlock()
+	return conn.lastErr
+}
 
-			e.buf.Clear()
-			gopacket.SerializeLayers(e.buf, conn.opts, &e.tcpHeader, gopacket.Payload(p))
-			if conn.tcpconn != nil {
-				_, err = e.handle.Write(e.buf.Bytes())
-			} else {
-				_, err = e.handle.WriteToIP(e.buf.Bytes(), &net.IPAddr{IP: raddr.IP})
-			}
-			// increase seq in flow
-			e.seq += uint32(len(p))
-			n = len(p)
-		})
+// closedErr returns the error of the operations on a closed connection, net.ErrClosed
+// once closed by Close, so that errors.Is tells it from an EOF of a peer.
+func (conn *TCPConn) closedErr() error {
+	if err := conn.LastError(); err != nil {
+		return err
 	}
-	return
+	return net.ErrClosed
 }
 
-// Close closes the connection.
-func (conn *TCPConn) Close() error {
-	var err error
-	conn.dieOnce.Do(func() {
-		// signal closing
-		close(conn.die)
-
-		// close all established tcp connections
-		if conn.tcpconn != nil { // client
-			setTTL(conn.tcpconn, 64)
-			err = conn.tcpconn.Close()
-		} else if conn.listener != nil {
-			err = conn.listener.Close() // server
+// send keepalive ACKs to every established flow each keepAlive interval
+func (conn *TCPConn) keepalive() {
+	defer conn.wg.Done()
+	ticker := time.NewTicker(conn.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
 			conn.flowsLock.Lock()
 			for k, v := range conn.flowTable {
-				if v.conn != nil {
-					setTTL(v.conn, 64)
-					v.conn.Close()
-				}
-				delete(conn.flowTable, k)
+				conn.ackFlow(v, k.addr())
 			}
 			conn.flowsLock.Unlock()
 		}
+	}
+}
 
-		// close handles
-		for k := range conn.handles {
-			conn.handles[k].Close()
+// check the local addresses of the handles each interval
+func (conn *TCPConn) watchAddresses(interval time.Duration) {
+	defer conn.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lost := make(map[string]bool)
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
+			if addrs, err := net.InterfaceAddrs(); err == nil && !conn.checkAddresses(addrs, lost) {
+				return
+			}
 		}
+	}
+}
 
-		// delete iptable
-		if conn.iptables != nil {
-			conn.iptables.Delete("filter", "OUTPUT", conn.iprule...)
+// checkAddresses reports the local addresses of the handles missing from addrs once, until they
+// are back, which are recorded in lost. A dialer fails on a lost address, then false is returned.
+func (conn *TCPConn) checkAddresses(addrs []net.Addr, lost map[string]bool) bool {
+	for _, handle := range conn.handles {
+		laddr := handle.LocalAddr().(*net.IPAddr)
+		assigned := false
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(laddr.IP) {
+				assigned = true
+				break
+			}
 		}
-		if conn.ip6tables != nil {
-			conn.ip6tables.Delete("filter", "OUTPUT", conn.ip6rule...)
+		key := laddr.String()
+		if assigned {
+			delete(lost, key)
+			continue
+		} else if lost[key] {
+			continue
 		}
-	})
-	return err
-}
-
-// LocalAddr returns the local network address.
+		lost[key] = true
+		conn.emit(Event{Type: EventAddressLost, Addr: laddr})
+		if log := conn.log(); log != nil {
+			log(LogWarn, "address lost", "addr", laddr)
+		}
+		if conn.tcpconn != nil {
+			conn.fail(ErrAddressLost)
+			return false
+		}
+	}
+	return true
+}
+
+// captureFlow capture every inbound packets based on rules of BPF
+func (conn *TCPConn) captureFlow(handle *net.IPConn, port int) {
+	defer conn.wg.Done()
+	buf := make([]byte, conn.snapLen)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	isIPv4 := handle.LocalAddr().(*net.IPAddr).IP.To4() != nil
+
+	// the kernel reports its drop counter of the socket along with the segments received after a drop
+	var drops uint32
+	if raw, err := handle.SyscallConn(); err == nil {
+		raw.Control(func(fd uintptr) {
+			syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1)
+		})
+	}
+
+	for {
+		n, oobn, _, addr, err := handle.ReadMsgIP(buf, oob)
+		if err != nil {
+			conn.fail(err)
+			return
+		}
+		atomic.AddUint64(&conn.received, 1)
+		if oobn > 0 {
+			if d, ok := rxqOverflow(oob[:oobn]); ok {
+				atomic.AddUint64(&conn.dropped, uint64(d-drops))
+				drops = d
+			}
+		}
+
+		// unlike ReadFromIP, ReadMsgIP keeps the IPv4 header, skip it by IHL
+		segment := buf[:n]
+		if isIPv4 && n >= 20 && segment[0]>>4 == 4 {
+			if hl := int(segment[0]&0x0f) << 2; hl >= 20 && hl <= n {
+				segment = segment[hl:]
+			}
+		}
+
+		if !conn.handleSegment(handle, segment, addr, port) {
+			return
+		}
+	}
+}
+
+// Replay feeds the TCP segments to the local port from a pcap file, of any link type gopacket
+// decodes, through the same flow maintenance and delivery as the segments captured, for replaying
+// captured traffic and for deterministic tests. n is the number of TCP segments read, Replay returns
+// at the end of the file, or once the connection is closed.
+//
+// Nothing is sent while Replay runs, neither the replies to the segments, like SYN-ACKs in raw mode
+// or window updates, nor the writes of the connection, which succeed without reaching the wire.
+func (conn *TCPConn) Replay(r io.Reader) (n int, err error) {
+	pr, err := pcapgo.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt32(&conn.replaying, 1)
+	defer atomic.AddInt32(&conn.replaying, -1)
+	port := conn.localPort()
+	for {
+		data, _, err := pr.ReadPacketData()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		packet := gopacket.NewPacket(data, pr.LinkType(), gopacket.DecodeOptions{NoCopy: true, Lazy: true})
+		network, transport := packet.NetworkLayer(), packet.TransportLayer()
+		if network == nil || transport == nil || transport.LayerType() != layers.LayerTypeTCP {
+			continue
+		}
+		src, dst := network.NetworkFlow().Endpoints()
+		handle := conn.replayHandle(net.IP(dst.Raw()))
+		if handle == nil {
+			continue
+		}
+		segment := append(append([]byte(nil), transport.LayerContents()...), transport.LayerPayload()...)
+		from := &net.IPAddr{IP: net.IP(src.Raw()), Zone: handle.LocalAddr().(*net.IPAddr).Zone}
+		if !conn.handleSegment(handle, segment, from, port) {
+			return n, conn.closedErr()
+		}
+		n++
+	}
+}
+
+// replayHandle returns the handle bound to dst, or else the first one of the family of dst
+func (conn *TCPConn) replayHandle(dst net.IP) *net.IPConn {
+	var family *net.IPConn
+	for _, handle := range conn.handles {
+		ip := handle.LocalAddr().(*net.IPAddr).IP
+		if ip.Equal(dst) {
+			return handle
+		}
+		if family == nil && (ip.To4() == nil) == (dst.To4() == nil) {
+			family = handle
+		}
+	}
+	return family
+}
+
+// handleSegment maintains the flow of a captured TCP segment from the address from, and delivers its payload,
+// a segment which fails to decode as TCP is discarded. It returns false once the connection is closed.
+func (conn *TCPConn) handleSegment(handle *net.IPConn, segment []byte, from *net.IPAddr, port int) bool {
+	// try decoding TCP frame from segment
+	packet := gopacket.NewPacket(segment, layers.LayerTypeTCP, gopacket.DecodeOptions{NoCopy: true, Lazy: true})
+	tcp, ok := packet.TransportLayer().(*layers.TCP)
+	if !ok || packet.ErrorLayer() != nil {
+		atomic.AddUint64(&conn.stats.ReadInvalid, 1)
+		return true
+	}
+
+	// port filtering
+	if int(tcp.DstPort) != port {
+		return true
+	}
+
+	// address building
+	var src net.TCPAddr
+	src.IP = from.IP
+	src.Zone = from.Zone
+	src.Port = int(tcp.SrcPort)
+
+	// handshake in raw mode
+	if conn.raw && conn.handshake(handle, &src, tcp) {
+		return true
+	}
+
+	// a segment carries data whether PSH is set or not, some stacks and middleboxes clear it
+	data := len(tcp.Payload) > 0
+
+	var orphan, duplicated, untracked, queued, dropped, closed, reset, synSeen, held bool
+	chMessage := conn.chMessage
+	// flow maintaince
+	conn.lockflow(&src, func(e *tcpFlow) {
+		if tcp.SYN && !tcp.ACK && conn.listener != nil && !conn.reusePort {
+			e.synSeen = true
+			synSeen = true
+		}
+		if e.conn == nil && !e.handshaked { // make sure it's related to net.TCPConn
+			// the data following a captured SYN may arrive before the system listener has
+			// returned the connection from AcceptTCP, it's held until then, and handled again,
+			// unless the SYN might be accepted by another listener sharing the port
+			if e.synSeen && data && len(e.held) < maxAhead {
+				e.ts = time.Now()
+				e.held = append(e.held, heldSegment{handle, append([]byte(nil), segment...), from})
+				held = true
+				return
+			}
+			orphan = true // mark as orphan if it's not related net.TCPConn
+		}
+		// a RST is only honored within the window, so that a blind one can hardly guess it
+		if tcp.RST && !orphan && e.acceptable(tcp.Seq, atomic.LoadUint32(&conn.window)) {
+			reset = true
+			return
+		}
+
+		// to keep track of TCP header related to this source
+		e.ts = time.Now()
+		if tsval, tsecr, ok := tcpTimestamps(tcp); ok {
+			e.tsRecent = tsval
+			if !e.tsSending {
+				if tsecr != 0 {
+					e.tsEcho = tsecr
+					e.tsClock = e.ts
+					e.tsReady = true
+				}
+			} else if tsecr-e.tsFirst < 1<<31 { // echo of our timestamps
+				if d := e.tsNow() - tsecr; d < 1<<31 {
+					e.rtt = time.Duration(d) * time.Millisecond
+					conn.sampleRTT(e.rtt)
+				}
+			}
+		}
+		// our sequence number is learnt once from the handshake, the SYN-ACK to a
+		// dialer, or the final ACK to a listener, then it's only advanced by our writes
+		if tcp.SYN {
+			e.ack = tcp.Seq + 1
+			e.ackKnown = true
+			e.seqKnown = false
+			// the system TCP connection reports the scale negotiated in the end, see windowScales
+			e.peerScale = windowScaleOf(tcp)
+		}
+		if tcp.ACK && (tcp.SYN || !e.seqKnown) {
+			e.seq = tcp.Ack
+			e.seqKnown = true
+		}
+		// the window is only meaningful with ACK, a zero one holds the writes of data until it reopens
+		if tcp.ACK && !orphan {
+			e.peerWindow = uint32(tcp.Window)
+			if !tcp.SYN { // the window of a SYN is never scaled
+				e.peerWindow <<= e.peerScale
+			}
+			atomic.StoreUint32(&conn.peerWindow, e.peerWindow)
+			if e.peerWindow == 0 && e.peerClosed == nil {
+				e.peerClosed = make(chan struct{})
+			} else if e.peerWindow != 0 {
+				e.openPeerWindow()
+			}
+		}
+		// ack only advances over the contiguous stream, a retransmission overlapping ack advances
+		// it to the segment end, and a segment beyond a gap is remembered until the gap is filled,
+		// one which can't be remembered is dropped, the peer retransmits it once the gap is filled.
+		// Without a captured SYN, the stream is picked up from the first segment.
+		var end uint32
+		var inOrder, beyond bool
+		if data || tcp.FIN {
+			end = tcp.Seq + uint32(len(tcp.Payload))
+			if tcp.FIN {
+				end++
+			}
+			if !e.ackKnown {
+				e.ack = tcp.Seq
+				e.ackKnown = true
+			}
+			duplicated = e.received(tcp.Seq, end)
+			inOrder = !seqAfter(tcp.Seq, e.ack) && seqAfter(end, e.ack)
+			beyond = seqAfter(tcp.Seq, e.ack) && !duplicated
+			untracked = beyond && len(e.ahead) >= maxAhead
+		}
+		if e.handle == nil {
+			close(e.ready)
+		}
+		if e.handle != handle { // the peer is reached through another local address
+			e.networkLayer = nil
+		}
+		e.handle = handle
+
+		// demultiplex to the accepted connection, the flow with data is a new peer
+		if !orphan && data && !duplicated && atomic.LoadInt32(&conn.accepting) != 0 {
+			if e.peer == nil {
+				peer := newPeerConn(conn, &src)
+				select {
+				case conn.chAccept <- peer:
+					e.peer = peer
+				default:
+					chMessage = nil // backlog is full
+				}
+			}
+			if e.peer != nil {
+				chMessage = e.peer.chMessage
+			}
+		}
+
+		// push data if it's not orphan, nor a retransmission of delivered data, before ack advances
+		// over it, so that a payload dropped on a full queue is retransmitted by the peer
+		if !orphan && data && !duplicated && !untracked {
+			// the payload references the capture buffer, which is overwritten by the next segment,
+			// the raw header is kept after it, for ReadFromTCP
+			n := len(tcp.Payload)
+			buf := conn.getPayload(n + len(tcp.Contents))
+			payload, hdr := (*buf)[:n:n], (*buf)[n:]
+			copy(payload, tcp.Payload)
+			copy(hdr, tcp.Contents)
+			select {
+			case chMessage <- message{bts: payload, addr: &src, hdr: hdr, buf: buf}:
+				queued = true
+			case <-conn.die:
+				conn.putPayload(buf)
+				closed = true
+			default:
+				conn.putPayload(buf)
+				dropped = true
+			}
+		}
+		if dropped || closed {
+			return
+		}
+		if inOrder {
+			e.ack = end
+			e.advance()
+		} else if beyond && !untracked {
+			e.ahead = append(e.ahead, seqRange{tcp.Seq, end})
+		}
+	})
+	if closed {
+		return false
+	}
+
+	if log := conn.log(); log != nil {
+		if synSeen {
+			log(LogDebug, "SYN seen", "addr", &src, "seq", tcp.Seq)
+		}
+		if held {
+			log(LogDebug, "segment held until accepted", "addr", &src, "seq", tcp.Seq)
+		}
+		if orphan {
+			log(LogDebug, "orphan segment ignored", "addr", &src, "seq", tcp.Seq, "flags", tcpHeaderOf(tcp).Flags)
+		}
+		if reset {
+			log(LogInfo, "flow reset", "addr", &src, "seq", tcp.Seq)
+		}
+	}
+
+	// the peer has reset the flow, a dialer is closed with the error, a listener forgets the flow
+	if reset {
+		err := &net.OpError{Op: "read", Net: "tcp", Source: conn.LocalAddr(), Addr: &src, Err: syscall.ECONNRESET}
+		if conn.tcpconn != nil {
+			conn.fail(err)
+			return false
+		}
+		key := newFlowKey(&src)
+		conn.flowsLock.Lock()
+		if e := conn.flowTable[key]; e != nil {
+			if e.peer != nil {
+				e.peer.shutdownWith(err)
+			}
+			conn.removeflow(key, e)
+		}
+		conn.flowsLock.Unlock()
+		return true
+	}
+
+	if duplicated {
+		atomic.AddUint64(&conn.stats.ReadDuplicated, 1)
+	} else if untracked {
+		atomic.AddUint64(&conn.stats.ReadDropped, 1)
+	} else if queued {
+		atomic.AddUint64(&conn.stats.ReadPackets, 1)
+		atomic.AddUint64(&conn.stats.ReadBytes, uint64(len(tcp.Payload)))
+		conn.emit(Event{Type: EventRead, Addr: &src, Bytes: len(tcp.Payload)})
+	} else if dropped {
+		atomic.AddUint64(&conn.stats.ReadDropped, 1)
+		conn.emit(Event{Type: EventDrop, Addr: &src, Bytes: len(tcp.Payload)})
+		if log := conn.log(); log != nil {
+			log(LogWarn, "packet dropped", "addr", &src, "bytes", len(tcp.Payload), "queue", cap(chMessage))
+		}
+		if conn.dynamicWindow && chMessage != nil { // the queue is full, not the backlog
+			conn.closeWindow(&src)
+		}
+	}
+
+	// the peer has finished, a listener forgets the flow after its data is delivered
+	if tcp.FIN && conn.tcpconn == nil && !dropped {
+		key := newFlowKey(&src)
+		conn.flowsLock.Lock()
+		e := conn.flowTable[key]
+		if e != nil {
+			conn.removeflow(key, e)
+		}
+		conn.flowsLock.Unlock()
+		if log := conn.log(); e != nil && log != nil {
+			log(LogInfo, "flow finished", "addr", &src, "seq", tcp.Seq)
+		}
+	}
+	return true
+}
+
+// getPayload returns a buffer of n bytes for a captured payload, from the pool if possible
+func (conn *TCPConn) getPayload(n int) *[]byte {
+	if buf, ok := conn.payloads.Get().(*[]byte); ok && cap(*buf) >= n {
+		*buf = (*buf)[:n]
+		return buf
+	}
+	size := conn.snapLen
+	if size < n {
+		size = n
+	}
+	buf := make([]byte, n, size)
+	return &buf
+}
+
+// putPayload recycles the buffer of a payload which has been copied out, nil is ignored
+func (conn *TCPConn) putPayload(buf *[]byte) {
+	if buf != nil {
+		conn.payloads.Put(buf)
+	}
+}
+
+// received reports whether segment [start, end) has been received, before ack or beyond a gap
+func (e *tcpFlow) received(start, end uint32) bool {
+	if !seqAfter(end, e.ack) {
+		return true
+	}
+	for _, r := range e.ahead {
+		if !seqAfter(r.start, start) && !seqAfter(end, r.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// advance moves ack over the segments beyond the gap it has reached, and forgets the ones behind it
+func (e *tcpFlow) advance() {
+	for k := 0; k < len(e.ahead); {
+		r := e.ahead[k]
+		if seqAfter(r.start, e.ack) {
+			k++
+			continue
+		}
+		if seqAfter(r.end, e.ack) {
+			e.ack = r.end
+		}
+		e.ahead = append(e.ahead[:k], e.ahead[k+1:]...)
+		k = 0 // ack might reach the ones skipped
+	}
+}
+
+// acceptable reports whether seq is within the receive window from ack, or is ack on a zero window
+func (e *tcpFlow) acceptable(seq, window uint32) bool {
+	return seq == e.ack || (!seqAfter(e.ack, seq) && seqAfter(e.ack+window, seq))
+}
+
+// openPeerWindow wakes up the writers waiting for the zero window of the peer to reopen,
+// the caller must hold flowsLock
+func (e *tcpFlow) openPeerWindow() {
+	if e.peerClosed != nil {
+		close(e.peerClosed)
+		e.peerClosed = nil
+	}
+}
+
+// seqAfter reports whether sequence number a is after b, modulo 2^32
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// tsNow returns the timestamp clock of the flow in milliseconds
+func (e *tcpFlow) tsNow() uint32 {
+	return e.tsEcho + uint32(time.Since(e.tsClock)/time.Millisecond)
+}
+
+// tcpTimestamps extracts TSval and TSecr from the timestamps option of a segment
+func tcpTimestamps(tcp *layers.TCP) (tsval uint32, tsecr uint32, ok bool) {
+	for _, opt := range tcp.Options {
+		if opt.OptionType == layers.TCPOptionKindTimestamps && len(opt.OptionData) == 8 {
+			return binary.BigEndian.Uint32(opt.OptionData), binary.BigEndian.Uint32(opt.OptionData[4:]), true
+		}
+	}
+	return 0, 0, false
+}
+
+// windowScaleOf returns the shift of the window scale option of a SYN, or 0 without the option,
+// a shift beyond 14 is taken as 14. The scale is in effect if both SYNs carry the option, which
+// the SYNs of the system TCP connections and the SYN-ACKs of the raw handshakes do.
+func windowScaleOf(tcp *layers.TCP) uint8 {
+	for _, opt := range tcp.Options {
+		if opt.OptionType == layers.TCPOptionKindWindowScale && len(opt.OptionData) == 1 {
+			if shift := opt.OptionData[0]; shift < maxWindowScale {
+				return shift
+			}
+			return maxWindowScale
+		}
+	}
+	return 0
+}
+
+// handshake answers SYNs with SYN-ACKs in raw mode, and establishes the flow on the final ACK,
+// it returns true if the segment has been consumed.
+func (conn *TCPConn) handshake(handle *net.IPConn, src *net.TCPAddr, tcp *layers.TCP) bool {
+	key := newFlowKey(src)
+	conn.flowsLock.Lock()
+	h := conn.synTable[key]
+
+	if tcp.SYN && !tcp.ACK {
+		if h == nil || h.peerISN != tcp.Seq { // a new connection attempt, retransmitted SYNs share the ISN
+			if h == nil && len(conn.synTable) >= maxHalfOpen {
+				for k, v := range conn.synTable {
+					if time.Now().Sub(v.ts) > synExpire {
+						delete(conn.synTable, k)
+					}
+				}
+				if len(conn.synTable) >= maxHalfOpen {
+					conn.flowsLock.Unlock()
+					return true
+				}
+			}
+			h = &halfOpenFlow{peerISN: tcp.Seq}
+			binary.Read(rand.Reader, binary.LittleEndian, &h.isn)
+			conn.synTable[key] = h
+		}
+		h.ts = time.Now()
+		h.peerScale = windowScaleOf(tcp)
+
+		synack := layers.TCP{
+			SrcPort: tcp.DstPort,
+			DstPort: tcp.SrcPort,
+			Seq:     h.isn,
+			Ack:     tcp.Seq + 1,
+			SYN:     true,
+			ACK:     true,
+			Window:  uint16(atomic.LoadUint32(&conn.window)),
+			Options: conn.synOptions(handle, tcp.Options),
+		}
+		// sent with flowsLock held like every write, so Close never closes the handle under it
+		if !isClosedChan(conn.die) {
+			conn.writeSegment(handle, networkLayer(handle, src.IP), &synack, nil, src)
+		}
+		conn.flowsLock.Unlock()
+		if log := conn.log(); log != nil {
+			log(LogDebug, "SYN answered", "addr", src, "isn", h.isn)
+		}
+		return true
+	}
+
+	// the final ACK
+	if h != nil && tcp.ACK && !tcp.SYN && tcp.Ack == h.isn+1 && time.Since(h.ts) <= synExpire {
+		delete(conn.synTable, key)
+		conn.flowsLock.Unlock()
+		conn.lockflow(src, func(e *tcpFlow) {
+			e.handshaked = true
+			e.seq = h.isn + 1
+			e.seqKnown = true
+			e.ack = h.peerISN + 1
+			e.ackKnown = true
+			e.peerScale = h.peerScale
+			e.localScale = 0 // see synOptions
+		})
+		if log := conn.log(); log != nil {
+			log(LogDebug, "handshake completed", "addr", src)
+		}
+		return false
+	}
+	conn.flowsLock.Unlock()
+	return false
+}
+
+// synOptions returns the options of the SYN-ACK answering a SYN with options opts, our MSS from the MTU
+// of handle, and a window scale of 0 if the peer offers one, so the peer's windows are scaled while ours
+// are advertised as they are. Timestamps and SACK are not offered, so the peer won't expect them.
+func (conn *TCPConn) synOptions(handle *net.IPConn, opts []layers.TCPOption) []layers.TCPOption {
+	mss, header := 65535, 20+20
+	if handle.LocalAddr().(*net.IPAddr).IP.To4() == nil {
+		header = 40 + 20
+	}
+	if n := conn.mtu[handle]; n > 0 && n-header < mss {
+		mss = n - header
+	}
+	reply := []layers.TCPOption{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{byte(mss >> 8), byte(mss)}}}
+	for _, opt := range opts {
+		if opt.OptionType == layers.TCPOptionKindWindowScale {
+			reply = append(reply, layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+				layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{0}})
+		}
+	}
+	return reply
+}
+
+// ReadFrom implements the PacketConn ReadFrom method.
+// A payload larger than p is truncated, see SetStrictRead and ReadMsgFrom.
+func (conn *TCPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, _, addr, err = conn.ReadMsgFrom(p)
+	return
+}
+
+// ReadMsgFrom is like ReadFrom, and returns the captured size of the payload as well,
+// the payload has been truncated if size is larger than n.
+func (conn *TCPConn) ReadMsgFrom(p []byte) (n, size int, addr net.Addr, err error) {
+	n, packet, err := conn.readMessage(p, nil)
+	return n, len(packet.bts), packet.addr, err
+}
+
+// ReadFromTCP is like ReadFrom, and returns the TCP header of the segment as well,
+// for inspecting the flags, window and options.
+func (conn *TCPConn) ReadFromTCP(p []byte) (n int, addr net.Addr, hdr TCPHeader, err error) {
+	n, packet, err := conn.readMessage(p, &hdr)
+	return n, packet.addr, hdr, err
+}
+
+// readMessage reads a message, and copies its payload into p, and its TCP header into hdr if not nil
+func (conn *TCPConn) readMessage(p []byte, hdr *TCPHeader) (n int, packet message, err error) {
+	select {
+	case <-conn.readDeadline.wait():
+		return 0, packet, errTimeout
+	case <-conn.die:
+		return 0, packet, conn.closedErr()
+	case packet = <-conn.chMessage:
+		if hdr != nil { // before the buffer is recycled
+			*hdr = headerOf(packet.hdr)
+		}
+		n, err = conn.copyMessage(p, packet)
+		return n, packet, err
+	}
+}
+
+// ReadFromNonblock is like ReadFrom, but returns ErrWouldBlock immediately if no packet is queued,
+// for polling many connections from a single goroutine. The read deadline is ignored.
+func (conn *TCPConn) ReadFromNonblock(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case <-conn.die:
+		return 0, nil, conn.closedErr()
+	case packet := <-conn.chMessage:
+		n, err = conn.copyMessage(p, packet)
+		return n, packet.addr, err
+	default:
+		return 0, nil, ErrWouldBlock
+	}
+}
+
+// ReadPacket is like ReadFrom, and returns the captured payload itself instead of copying it,
+// for relays which send it on right away. The payload belongs to the caller until release is
+// called, which recycles its buffer for the segments captured next, so the payload must not be
+// used after release. release is never nil, it is idempotent, and a payload never released is
+// left to the garbage collector.
+func (conn *TCPConn) ReadPacket() (payload []byte, addr net.Addr, release func(), err error) {
+	select {
+	case <-conn.readDeadline.wait():
+		return nil, nil, noRelease, errTimeout
+	case <-conn.die:
+		return nil, nil, noRelease, conn.closedErr()
+	case packet := <-conn.chMessage:
+		conn.reopenWindow(conn.chMessage)
+		buf := packet.buf
+		release = func() {
+			conn.putPayload(buf)
+			buf = nil
+		}
+		return packet.bts, packet.addr, release, nil
+	}
+}
+
+// noRelease is the release of ReadPacket without payload
+func noRelease() {}
+
+// copyMessage copies the payload of a message into p, and recycles its buffer
+func (conn *TCPConn) copyMessage(p []byte, packet message) (n int, err error) {
+	n = copy(p, packet.bts)
+	conn.putPayload(packet.buf)
+	conn.reopenWindow(conn.chMessage)
+	if n < len(packet.bts) && atomic.LoadInt32(&conn.strictRead) != 0 {
+		return n, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// ReadBatch reads up to len(packets) packets in one call, it blocks until the first packet
+// arrives, then takes what has been queued without waiting. packets[i] is resliced to the
+// length read and addrs[i] is set to its source, n is the number of packets read.
+// In strict read mode, a truncated packet stops the batch with io.ErrShortBuffer.
+func (conn *TCPConn) ReadBatch(packets [][]byte, addrs []net.Addr) (n int, err error) {
+	if len(addrs) < len(packets) {
+		packets = packets[:len(addrs)]
+	}
+	if len(packets) == 0 {
+		return 0, nil
+	}
+
+	var packet message
+	select {
+	case <-conn.readDeadline.wait():
+		return 0, errTimeout
+	case <-conn.die:
+		return 0, conn.closedErr()
+	case packet = <-conn.chMessage:
+	}
+
+	strict := atomic.LoadInt32(&conn.strictRead) != 0
+	for {
+		nr := copy(packets[n][:cap(packets[n])], packet.bts)
+		conn.putPayload(packet.buf)
+		conn.reopenWindow(conn.chMessage)
+		packets[n] = packets[n][:nr]
+		addrs[n] = packet.addr
+		n++
+		if nr < len(packet.bts) && strict {
+			return n, io.ErrShortBuffer
+		}
+		if n == len(packets) {
+			return n, nil
+		}
+
+		select {
+		case packet = <-conn.chMessage:
+		default:
+			return n, nil
+		}
+	}
+}
+
+// WriteBatch writes packets[i] to addrs[i] in order, n is the number of packets written,
+// it stops at the first error. The flows, and the zero windows of the peers to reopen, like
+// WriteTo, are waited for ahead, then all packets are sent from reused serialization buffers,
+// the flow table is taken for each packet, so a large batch doesn't hold up the other writers
+// and the capture. Raw sockets take one segment per system call, so the cost of the system calls
+// remains per packet.
+func (conn *TCPConn) WriteBatch(packets [][]byte, addrs []net.Addr) (n int, err error) {
+	if len(addrs) < len(packets) {
+		packets = packets[:len(addrs)]
+	}
+
+	timeout := conn.writeDeadline.wait()
+	select {
+	case <-timeout:
+		return 0, errTimeout
+	case <-conn.die:
+		return 0, conn.closedErr()
+	default:
+	}
+
+	// the packets up to the first failed address are sent, then its error is returned
+	raddrs := make([]*net.TCPAddr, 0, len(packets))
+	var werr error
+	for i := range packets {
+		raddr, err := conn.waitflow(addrs[i], timeout)
+		if err == nil {
+			err = conn.waitWindow(raddr, addrs[i], timeout)
+		}
+		if err != nil {
+			werr = err
+			break
+		}
+		raddrs = append(raddrs, raddr)
+	}
+
+	n, err = conn.sendBatch(packets, raddrs, addrs, timeout)
+	for k := 0; k < n; k++ {
+		conn.emit(Event{Type: EventWrite, Addr: raddrs[k], Bytes: len(packets[k])})
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, werr
+}
+
+// sendBatch sends packets to the resolved raddrs one by one, see sendTo
+func (conn *TCPConn) sendBatch(packets [][]byte, raddrs []*net.TCPAddr, addrs []net.Addr, timeout <-chan struct{}) (n int, err error) {
+	for n = range raddrs {
+		if _, err = conn.sendTo(packets[n], raddrs[n], addrs[n], FlagPSH|FlagACK, 0, timeout); err != nil {
+			return n, err
+		}
+	}
+	return len(raddrs), nil
+}
+
+// Stats returns a snapshot of the counters of the connection.
+func (conn *TCPConn) Stats() Stats {
+	return Stats{
+		ReadPackets:    atomic.LoadUint64(&conn.stats.ReadPackets),
+		ReadBytes:      atomic.LoadUint64(&conn.stats.ReadBytes),
+		WritePackets:   atomic.LoadUint64(&conn.stats.WritePackets),
+		WriteBytes:     atomic.LoadUint64(&conn.stats.WriteBytes),
+		ReadDropped:    atomic.LoadUint64(&conn.stats.ReadDropped),
+		ReadInvalid:    atomic.LoadUint64(&conn.stats.ReadInvalid),
+		ReadDuplicated: atomic.LoadUint64(&conn.stats.ReadDuplicated),
+	}
+}
+
+// SocketStats returns a snapshot of the counters of the raw sockets, the kernel drops
+// segments when the reader falls behind longer than the receive buffers can absorb,
+// see SetReadBuffer.
+func (conn *TCPConn) SocketStats() SocketStats {
+	return SocketStats{
+		Received: atomic.LoadUint64(&conn.received),
+		Dropped:  atomic.LoadUint64(&conn.dropped),
+	}
+}
+
+// SetEventHandler sets the function called on the events of the connection, like a packet
+// read or written, for pushing metrics without polling Stats. The handler is called synchronously
+// by the capture and the writers, without holding any lock of the connection, so it may call
+// the methods of the connection, but it should return promptly. Nil removes the handler.
+func (conn *TCPConn) SetEventHandler(handler func(Event)) {
+	conn.handler.Store(eventHandler(handler))
+}
+
+// emit calls the event handler if set, the caller must not hold flowsLock
+func (conn *TCPConn) emit(ev Event) {
+	if handler, _ := conn.handler.Load().(eventHandler); handler != nil {
+		handler(ev)
+	}
+}
+
+// SetLogger sets the function called with the decisions of the capture and the writers, like
+// a flow created, a SYN seen, a flow finished, a packet dropped or a segment serialized, along
+// with key-value pairs, like "addr" and the remote address. The logger may be called with
+// locks of the connection held, so it must not call the methods of the connection. Without
+// logger, no message is built. Nil removes the logger.
+func (conn *TCPConn) SetLogger(logger func(level, msg string, kv ...interface{})) {
+	conn.logger.Store(logFunc(logger))
+}
+
+// log returns the logger, or nil if none is set, so a call site builds no message without it
+func (conn *TCPConn) log() logFunc {
+	log, _ := conn.logger.Load().(logFunc)
+	return log
+}
+
+// SetStrictRead controls what ReadFrom does when p is smaller than the payload received,
+// by default the tail of the payload is discarded silently, in strict mode the truncated
+// bytes are returned along with io.ErrShortBuffer.
+func (conn *TCPConn) SetStrictRead(strict bool) {
+	var v int32
+	if strict {
+		v = 1
+	}
+	atomic.StoreInt32(&conn.strictRead, v)
+}
+
+// WriteTo implements the PacketConn WriteTo method, the segments are sent with PSH and ACK.
+// While the peer advertises a zero window, WriteTo blocks until the window reopens, or returns
+// a timeout error with n of 0 once the write deadline is exceeded, nothing is sent meanwhile.
+func (conn *TCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return conn.writeTo(p, addr, FlagPSH|FlagACK, 0, conn.writeDeadline.wait())
+}
+
+// WriteToWithFlags is like WriteTo, with the flags of the segment, p might be empty, like for a pure ACK.
+// The sequence number advances by the payload, and one more for each of SYN and FIN. A RST or FIN
+// tears down the system TCP connection of the peer, so the follow-up writes are likely answered by RSTs.
+// URG is sent with a zero urgent pointer, see WriteToUrgent.
+func (conn *TCPConn) WriteToWithFlags(p []byte, addr net.Addr, flags TCPFlags) (n int, err error) {
+	return conn.writeTo(p, addr, flags, 0, conn.writeDeadline.wait())
+}
+
+// WriteToUrgent is like WriteTo, and sends p with URG and the urgent pointer urgent, the offset from
+// the sequence number of the segment to the byte following the urgent data, RFC 6093, so the urgent
+// data is p[:urgent]. urgent must be within [1, len(p)]. The other writes clear URG and the pointer.
+func (conn *TCPConn) WriteToUrgent(p []byte, addr net.Addr, urgent uint16) (n int, err error) {
+	if urgent == 0 || int(urgent) > len(p) {
+		return 0, errInvalidUrgent
+	}
+	return conn.writeTo(p, addr, FlagURG|FlagPSH|FlagACK, urgent, conn.writeDeadline.wait())
+}
+
+// writeTo sends p to addr with flags, it fails with timeout once the timeout channel is closed
+func (conn *TCPConn) writeTo(p []byte, addr net.Addr, flags TCPFlags, urgent uint16, timeout <-chan struct{}) (n int, err error) {
+	select {
+	case <-timeout:
+		return 0, errTimeout
+	case <-conn.die:
+		return 0, conn.closedErr()
+	default:
+		raddr, err := conn.waitflow(addr, timeout)
+		if err != nil {
+			return 0, err
+		}
+		if len(p) > 0 {
+			if err := conn.waitWindow(raddr, addr, timeout); err != nil {
+				return 0, err
+			}
+		}
+
+		n, werr := conn.sendTo(p, raddr, addr, flags, urgent, timeout)
+		if werr == nil {
+			conn.emit(Event{Type: EventWrite, Addr: raddr, Bytes: n})
+		}
+		return n, werr
+	}
+}
+
+// sendTo sends p to the flow of raddr resolved from addr, retried on transient errors, see retrySend.
+// The segment is built and sent, and seq is advanced with flowsLock held, so concurrent writers to
+// a peer never share a sequence number.
+func (conn *TCPConn) sendTo(p []byte, raddr *net.TCPAddr, addr net.Addr, flags TCPFlags, urgent uint16, timeout <-chan struct{}) (n int, err error) {
+	ok := true
+	err = conn.retrySend(timeout, func() (err error) {
+		ok = conn.updateflow(raddr, func(e *tcpFlow) {
+			n, err = conn.sendflow(e, p, raddr, flags, urgent)
+		})
+		return err
+	})
+	if !ok { // expired while waiting
+		return 0, errNoFlow(addr)
+	}
+	return n, err
+}
+
+// waitflow resolves addr, and waits for the first packet of its flow if it has not been observed
+func (conn *TCPConn) waitflow(addr net.Addr, timeout <-chan struct{}) (*net.TCPAddr, error) {
+	raddr, err := net.ResolveTCPAddr("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	e := conn.lookupFlow(raddr)
+	if e == nil {
+		return nil, errNoFlow(addr)
+	}
+	select {
+	case <-e.ready:
+		return raddr, nil
+	case <-timeout:
+		return nil, errTimeout
+	case <-conn.die:
+		return nil, conn.closedErr()
+	}
+}
+
+// waitWindow waits for the zero window advertised by the peer of raddr to reopen, a peer
+// doesn't accept data beyond its window. The window reopens by the next ACK of the peer, like
+// the update sent once its reader catches up, or the answer to a probe, which is sent on a
+// backoff while waiting, so a lost window update doesn't hold the writes forever.
+func (conn *TCPConn) waitWindow(raddr *net.TCPAddr, addr net.Addr, timeout <-chan struct{}) error {
+	probe := time.NewTimer(windowProbe)
+	defer probe.Stop()
+	backoff := windowProbe
+	for {
+		var closed chan struct{}
+		if !conn.updateflow(raddr, func(e *tcpFlow) { closed = e.peerClosed }) {
+			return errNoFlow(addr)
+		}
+		if closed == nil {
+			return nil
+		}
+		select {
+		case <-closed:
+		case <-probe.C:
+			conn.updateflow(raddr, func(e *tcpFlow) {
+				if e.peerClosed != nil {
+					conn.probeWindow(e, raddr)
+				}
+			})
+			if backoff *= 2; backoff > maxWindowProbe {
+				backoff = maxWindowProbe
+			}
+			probe.Reset(backoff)
+		case <-timeout:
+			return errTimeout
+		case <-conn.die:
+			return conn.closedErr()
+		}
+	}
+}
+
+// sendflow sends p to the peer of the flow, and advances seq, the caller must hold flowsLock.
+func (conn *TCPConn) sendflow(e *tcpFlow, p []byte, raddr *net.TCPAddr, flags TCPFlags, urgent uint16) (n int, err error) {
+	// if the flow doesn't have handle , assume this packet has lost, without notification
+	if e.handle == nil {
+		return len(p), nil
+	}
+	if isClosedChan(conn.die) { // the handles are closed by Close, with flowsLock held
+		return 0, conn.closedErr()
+	}
+	if e.finSent {
+		return 0, errWriteClosed
+	}
+	if len(p) > conn.maxPayload(e.handle) {
+		return 0, ErrMessageTooLong
+	}
+
+	// build tcp header with local and remote port
+	e.tcpHeader.SrcPort = layers.TCPPort(conn.localPort())
+	e.tcpHeader.DstPort = layers.TCPPort(raddr.Port)
+	e.tcpHeader.Window = conn.advertisedWindow(e)
+	e.tcpHeader.Ack = e.ack
+	e.tcpHeader.Seq = e.seq
+	flags.apply(&e.tcpHeader)
+	e.tcpHeader.Urgent = 0
+	if flags&FlagURG != 0 {
+		e.tcpHeader.Urgent = urgent
+	}
+	e.tcpHeader.Options = e.tcpHeader.Options[:0]
+	e.tcpHeader.Padding = nil // recomputed for the options of this segment
+	if atomic.LoadInt32(&conn.timestamps) != 0 && e.tsReady && conn.tcpOptionsLen <= 40-12 {
+		tsval := e.tsNow()
+		if !e.tsSending {
+			e.tsSending = true
+			e.tsFirst = tsval
+		}
+		binary.BigEndian.PutUint32(e.tsOpt[:], tsval)
+		binary.BigEndian.PutUint32(e.tsOpt[4:], e.tsRecent)
+		e.tcpHeader.Options = append(e.tcpHeader.Options,
+			layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+			layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+			layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: e.tsOpt[:]})
+	}
+	e.tcpHeader.Options = append(e.tcpHeader.Options, conn.tcpOptions...)
+
+	if err = conn.writeSegment(e.handle, e.network(raddr), &e.tcpHeader, p, raddr); err != nil {
+		return 0, err
+	}
+	// increase seq in flow, SYN and FIN take a sequence number each
+	e.seq += uint32(len(p))
+	if flags&FlagSYN != 0 {
+		e.seq++
+	}
+	if flags&FlagFIN != 0 {
+		e.seq++
+		e.finSent = true
+	}
+	atomic.AddUint64(&conn.stats.WritePackets, 1)
+	atomic.AddUint64(&conn.stats.WriteBytes, uint64(len(p)))
+	return len(p), nil
+}
+
+// CloseWrite sends a FIN to the peer of a dialed connection, like CloseWrite of net.TCPConn, ReadFrom
+// keeps receiving, and the writes fail afterwards. A listener of tcpraw forgets the flow on the FIN.
+func (conn *TCPConn) CloseWrite() error {
+	if conn.tcpconn == nil {
+		return errNotDialer
+	}
+	return conn.CloseWriteTo(conn.tcpconn.RemoteAddr())
+}
+
+// CloseWriteTo is like CloseWrite, for the flow to addr.
+func (conn *TCPConn) CloseWriteTo(addr net.Addr) error {
+	_, err := conn.writeTo(nil, addr, FlagFIN|FlagACK, 0, conn.writeDeadline.wait())
+	return err
+}
+
+// HasFlow reports whether a flow to the remote address is established, WriteTo fails
+// on an address without flow.
+func (conn *TCPConn) HasFlow(addr net.Addr) bool {
+	return conn.lookupFlow(addr) != nil
+}
+
+// SetTimestamps controls whether the TCP timestamps option is sent, it takes effect on the flows
+// whose peer sends timestamps. Our TSval continues the clock which the peer echoes, so that the
+// peer's PAWS check on the system TCP connection still passes.
+func (conn *TCPConn) SetTimestamps(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&conn.timestamps, v)
+}
+
+// SetTCPOptions sets the TCP options attached to every data segment sent by WriteTo, after
+// the timestamps option, the data offset is computed with padding to 4 bytes. Options take at most
+// 40 bytes, and timestamps are only sent if 12 bytes are left. The options are sent as they are,
+// an MSS option doesn't limit the payload size of WriteTo, and the peer's stack only honors MSS on
+// SYNs, so the payload plus options should fit the path MTU anyway. The option lengths are computed
+// from the data, OptionLength is ignored. Nil clears the options.
+func (conn *TCPConn) SetTCPOptions(options []layers.TCPOption) error {
+	var length int
+	copied := make([]layers.TCPOption, len(options))
+	for k, o := range options {
+		copied[k] = o
+		copied[k].OptionData = append([]byte(nil), o.OptionData...)
+		switch o.OptionType {
+		case layers.TCPOptionKindEndList, layers.TCPOptionKindNop:
+			copied[k].OptionLength = 1
+			length++
+		default:
+			if len(o.OptionData) > 40-2 {
+				return errTCPOptions
+			}
+			copied[k].OptionLength = uint8(2 + len(o.OptionData))
+			length += 2 + len(o.OptionData)
+		}
+	}
+	if length > 40 {
+		return errTCPOptions
+	}
+
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	conn.tcpOptions = copied
+	conn.tcpOptionsLen = length
+	return nil
+}
+
+// FlowRTT returns the latest round-trip time measured from the TCP timestamps echoed by addr,
+// or 0 if not measured yet. Timestamps must be enabled by SetTimestamps.
+func (conn *TCPConn) FlowRTT(addr net.Addr) time.Duration {
+	key, ok := flowKeyOf(addr)
+	if !ok {
+		return 0
+	}
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	if e := conn.flowTable[key]; e != nil {
+		return e.rtt
+	}
+	return 0
+}
+
+// Seq returns the sequence number of the next segment sent to the remote address of a dialed
+// connection, for correlating with a packet capture, or 0 on a listener, see Flows.
+func (conn *TCPConn) Seq() uint32 {
+	seq, _ := conn.dialedFlow()
+	return seq
+}
+
+// Ack returns the acknowledge number sent to the remote address of a dialed connection, the next
+// sequence number expected from the peer, or 0 on a listener, see Flows.
+func (conn *TCPConn) Ack() uint32 {
+	_, ack := conn.dialedFlow()
+	return ack
+}
+
+// dialedFlow returns the seq and ack of the flow of a dialed connection
+func (conn *TCPConn) dialedFlow() (seq, ack uint32) {
+	if conn.tcpconn == nil {
+		return 0, 0
+	}
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	if e := conn.flowTable[newFlowKey(conn.tcpconn.RemoteAddr().(*net.TCPAddr))]; e != nil {
+		return e.seq, e.ack
+	}
+	return 0, 0
+}
+
+// PeerWindow returns the window in bytes of the latest ACK captured, from the remote address of a
+// dialed connection, or from any peer of a listener, see Flows for the window of every peer. The
+// writes of data wait while the window is 0, see WriteTo.
+func (conn *TCPConn) PeerWindow() uint32 {
+	return atomic.LoadUint32(&conn.peerWindow)
+}
+
+// Flows returns a snapshot of the tracked state of every flow, for debugging.
+func (conn *TCPConn) Flows() []FlowInfo {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	flows := make([]FlowInfo, 0, len(conn.flowTable))
+	for key, e := range conn.flowTable {
+		flows = append(flows, FlowInfo{Addr: key.addr(), Seq: e.seq, Ack: e.ack, Window: e.peerWindow})
+	}
+	return flows
+}
+
+// RTT returns the smoothed round-trip time over the samples of all flows, like SRTT of RFC 6298,
+// or 0 if not measured yet. Timestamps must be enabled by SetTimestamps, and echoed by the peers.
+func (conn *TCPConn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&conn.srtt))
+}
+
+// sampleRTT folds a sample into the smoothed RTT with a gain of 1/8, the caller must hold flowsLock
+func (conn *TCPConn) sampleRTT(rtt time.Duration) {
+	srtt := atomic.LoadInt64(&conn.srtt)
+	if srtt == 0 {
+		srtt = int64(rtt)
+	} else {
+		srtt += (int64(rtt) - srtt) / 8
+	}
+	atomic.StoreInt64(&conn.srtt, srtt)
+}
+
+// MaxPayloadSize returns the largest payload WriteTo sends in a single unfragmented packet, the MTU
+// of the local interfaces, and of Options.SendInterface if set, minus the IP header and the TCP header, with the timestamps option if
+// enabled by SetTimestamps, and the options of SetTCPOptions. Larger writes fail with ErrMessageTooLong.
+// The MTU of the path beyond the local interface is not discovered. With Options.Fragment, only the
+// length fields of the IP headers limit the payload.
+func (conn *TCPConn) MaxPayloadSize() int {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	size := -1
+	for k := range conn.handles {
+		if n := conn.maxPayload(conn.handles[k]); size < 0 || n < size {
+			size = n
+		}
+	}
+	return size
+}
+
+// maxPayload returns the largest payload sent through handle without fragmentation, the caller must hold flowsLock
+func (conn *TCPConn) maxPayload(handle *net.IPConn) int {
+	// the total length field of IPv4 and the payload length field of IPv6 limit a packet without MTU
+	mtu, header := 65535, 20
+	if handle.LocalAddr().(*net.IPAddr).IP.To4() == nil {
+		mtu, header = 65535+40, 40
+	}
+	if n := conn.mtu[handle]; n > 0 && n < mtu && !conn.fragment {
+		mtu = n
+	}
+
+	options := conn.tcpOptionsLen
+	if atomic.LoadInt32(&conn.timestamps) != 0 && options <= 40-12 {
+		options += 12
+	}
+	return mtu - header - 20 - (options+3)/4*4
+}
+
+// loadMTU records the MTU of the interface of every handle
+func (conn *TCPConn) loadMTU() {
+	conn.mtu = make(map[*net.IPConn]int)
+	for _, handle := range conn.handles {
+		if ifi := interfaceOf(handle.LocalAddr().(*net.IPAddr)); ifi != nil {
+			conn.mtu[handle] = ifi.MTU
+		}
+	}
+}
+
+// LinkType returns the link layer of the interfaces owning the local addresses of the connection,
+// LinkUnknown if an address has no interface, or the interfaces of a listener differ.
+func (conn *TCPConn) LinkType() LinkType {
+	link := LinkUnknown
+	for k := range conn.handles {
+		ifi := interfaceOf(conn.handles[k].LocalAddr().(*net.IPAddr))
+		t := linkTypeOf(ifi)
+		if k > 0 && t != link {
+			return LinkUnknown
+		}
+		link = t
+	}
+	return link
+}
+
+// localPort returns the TCP port of our side
+func (conn *TCPConn) localPort() int {
+	if conn.tcpconn != nil {
+		return conn.tcpconn.LocalAddr().(*net.TCPAddr).Port
+	}
+	return conn.laddr.Port
+}
+
+// reset sends a RST to the peer of the flow with current seq & ack, so the peer can release
+// its state promptly, nothing is sent before seq is learnt, the peer would drop it out of the
+// window. The caller must hold flowsLock.
+func (conn *TCPConn) reset(e *tcpFlow, raddr *net.TCPAddr) error {
+	if e.handle == nil || (e.conn == nil && !e.handshaked) || !e.seqKnown {
+		return nil
+	}
+
+	rst := layers.TCP{
+		SrcPort: layers.TCPPort(conn.localPort()),
+		DstPort: layers.TCPPort(raddr.Port),
+		Seq:     e.seq,
+		Ack:     e.ack,
+		RST:     true,
+		ACK:     true,
+	}
+	return conn.writeSegment(e.handle, e.network(raddr), &rst, nil, raddr)
+}
+
+// ackFlow sends a zero-length ACK to the peer of the flow with current seq & ack, which refreshes
+// the NAT mappings along the path and the peer's view of our window, the caller must hold flowsLock.
+func (conn *TCPConn) ackFlow(e *tcpFlow, raddr *net.TCPAddr) error {
+	return conn.ackAt(e, raddr, e.seq)
+}
+
+// probeWindow sends a zero-length ACK with the sequence number before seq, out of the zero window
+// of the peer, which answers it with an ACK carrying its window, like the zero window probes of
+// the kernel, the caller must hold flowsLock.
+func (conn *TCPConn) probeWindow(e *tcpFlow, raddr *net.TCPAddr) error {
+	return conn.ackAt(e, raddr, e.seq-1)
+}
+
+// ackAt sends a zero-length ACK with sequence number seq to the peer of the flow, the caller must hold flowsLock
+func (conn *TCPConn) ackAt(e *tcpFlow, raddr *net.TCPAddr, seq uint32) error {
+	if e.handle == nil || (e.conn == nil && !e.handshaked) {
+		return nil
+	}
+
+	ack := layers.TCP{
+		SrcPort: layers.TCPPort(conn.localPort()),
+		DstPort: layers.TCPPort(raddr.Port),
+		Seq:     seq,
+		Ack:     e.ack,
+		ACK:     true,
+		Window:  conn.advertisedWindow(e),
+	}
+	return conn.writeSegment(e.handle, e.network(raddr), &ack, nil, raddr)
+}
+
+// closeWindow advertises a zero window to the peer of a full queue, every dropped segment
+// is answered, like the window probes
+func (conn *TCPConn) closeWindow(raddr *net.TCPAddr) {
+	conn.updateflow(raddr, func(e *tcpFlow) {
+		e.windowClosed = true
+		atomic.StoreInt32(&conn.windowClosed, 1)
+		conn.ackFlow(e, raddr)
+	})
+}
+
+// reopenWindow advertises the window to the peers whose queues have been emptied by half,
+// after a read of queue which has a zero window advertised
+func (conn *TCPConn) reopenWindow(queue chan message) {
+	if atomic.LoadInt32(&conn.windowClosed) == 0 || len(queue) > cap(queue)/2 {
+		return
+	}
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	closed := false
+	for key, e := range conn.flowTable {
+		if !e.windowClosed {
+			continue
+		}
+		if q := conn.queueOf(e); len(q) > cap(q)/2 {
+			closed = true
+			continue
+		}
+		e.windowClosed = false
+		conn.ackFlow(e, key.addr())
+	}
+	if !closed {
+		atomic.StoreInt32(&conn.windowClosed, 0)
+	}
+}
+
+// queueOf returns the queue the packets of the flow are delivered to, the caller must hold flowsLock
+func (conn *TCPConn) queueOf(e *tcpFlow) chan message {
+	if e.peer != nil {
+		return e.peer.chMessage
+	}
+	return conn.chMessage
+}
+
+// advertisedWindow returns the window advertised to the peer of the flow, the caller must hold flowsLock
+func (conn *TCPConn) advertisedWindow(e *tcpFlow) uint16 {
+	window := atomic.LoadUint32(&conn.window)
+	if conn.dynamicWindow {
+		queue := conn.queueOf(e)
+		free := uint64(cap(queue) - len(queue))
+		window = uint32(uint64(window) * free / uint64(cap(queue)))
+	}
+	// the kernel advertises its windows scaled once the handshake negotiated a scale
+	if conn.stealth && window != 0 {
+		if window >>= e.localScale; window == 0 {
+			window = 1
+		}
+	}
+	return uint16(window)
+}
+
+// network returns the network layer of the flow, built on first use after the handle is known,
+// the caller must hold flowsLock.
+func (e *tcpFlow) network(raddr *net.TCPAddr) gopacket.NetworkLayer {
+	if e.networkLayer == nil {
+		e.networkLayer = networkLayer(e.handle, raddr.IP)
+	}
+	return e.networkLayer
+}
+
+// networkLayer builds the IP header with src & dst ip for TCP checksum, only the TCP segment is sent,
+// the kernel writes the IP header, with an IPv4 ID incremented on every packet. Nothing is copied from
+// the captured packets, IPv6 raw sockets strip the extension headers of the captured packets, and the
+// pseudo-header of the checksum always carries TCP as next header, like the packets the kernel sends.
+func networkLayer(handle *net.IPConn, dst net.IP) gopacket.NetworkLayer {
+	if dst.To4() != nil {
+		return &layers.IPv4{
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    handle.LocalAddr().(*net.IPAddr).IP.To4(),
+			DstIP:    dst.To4(),
+		}
+	}
+	return &layers.IPv6{
+		NextHeader: layers.IPProtocolTCP,
+		SrcIP:      handle.LocalAddr().(*net.IPAddr).IP.To16(),
+		DstIP:      dst.To16(),
+	}
+}
+
+// writeSegment serializes a TCP segment into a pooled buffer, and sends it to raddr through handle,
+// network is the IP header for the checksum
+func (conn *TCPConn) writeSegment(handle *net.IPConn, network gopacket.NetworkLayer, tcp *layers.TCP, payload []byte, raddr *net.TCPAddr) error {
+	if atomic.LoadInt32(&conn.replaying) != 0 { // see Replay
+		return nil
+	}
+	handle = conn.sender(handle)
+	if err := tcp.SetNetworkLayerForChecksum(network); err != nil {
+		return err
+	}
+
+	// the buffer goes back to the pool after the kernel has copied the segment
+	buf := serializePool.Get().(gopacket.SerializeBuffer)
+	defer serializePool.Put(buf)
+	buf.Clear()
+	opts := conn.opts
+	if conn.checksumOffload && handle.LocalAddr().(*net.IPAddr).IP.To4() == nil {
+		opts.ComputeChecksums = false // computed by the kernel, see setChecksumOffload
+		tcp.Checksum = 0
+	}
+	start := time.Now()
+	if err := gopacket.SerializeLayers(buf, opts, tcp, gopacket.Payload(payload)); err != nil {
+		return err
+	}
+	conn.timeSerialize(time.Since(start))
+	if log := conn.log(); log != nil {
+		log(LogDebug, "segment serialized", "addr", raddr, "seq", tcp.Seq, "ack", tcp.Ack,
+			"flags", tcpHeaderOf(tcp).Flags, "bytes", len(payload), "checksum", tcp.Checksum, "offload", !opts.ComputeChecksums)
+	}
+
+	n, err := sendSegment(handle, buf.Bytes(), raddr, atomic.LoadUint32(&conn.flowLabel))
+	if err == nil && n != len(buf.Bytes()) { // the segment must be sent as a whole
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// dialIP connects a raw socket of dialer to raddr, which selects the local address towards it,
+// a variable so the tests can fail the dials
+var dialIP = func(ctx context.Context, dialer *net.Dialer, raddr *net.IPAddr) (net.Conn, error) {
+	return dialer.DialContext(ctx, "ip:tcp", raddr.String())
+}
+
+// sendSegment writes the serialized segment b to raddr through handle, with the flow label fl of IPv6,
+// a variable so the tests can fail the writes
+var sendSegment = func(handle *net.IPConn, b []byte, raddr *net.TCPAddr, fl uint32) (int, error) {
+	if fl != 0 && raddr.IP.To4() == nil { // the flow label is carried by a control message
+		return writeFlow(handle, b, raddr, fl)
+	} else if handle.RemoteAddr() != nil { // connected raw socket
+		return handle.Write(b)
+	}
+	return handle.WriteToIP(b, &net.IPAddr{IP: raddr.IP, Zone: raddr.Zone})
+}
+
+// retrySend calls send until it succeeds, fails with an error other than a transient one, or the
+// retries of Options.RetryWrites are exhausted. send takes flowsLock itself, so the backoff between
+// the attempts is slept with the lock released, and each attempt builds the segment from the seq of
+// the flow then. It fails with timeout once the timeout channel is closed.
+func (conn *TCPConn) retrySend(timeout <-chan struct{}, send func() error) error {
+	backoff := retryBackoff
+	for retry := 0; ; retry++ {
+		err := send()
+		if err == nil || retry >= conn.retryWrites || !isTransient(err) {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-timeout:
+			return errTimeout
+		case <-conn.die:
+			return conn.closedErr()
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// timeSerialize counts the time spent serializing a segment in the histogram of SerializeTiming
+func (conn *TCPConn) timeSerialize(d time.Duration) {
+	k := bits.Len64(uint64(d))
+	if k >= timingBuckets {
+		k = timingBuckets - 1
+	}
+	atomic.AddUint64(&conn.serializeTiming[k], 1)
+	atomic.AddInt64(&conn.serializeTotal, int64(d))
+}
+
+// SerializeTiming returns the histogram of the time spent building every segment sent, from the
+// TCP header to the checksum, for comparing the serialization before and after a change, it
+// excludes the system calls. The buckets are read one by one, so the snapshot is only consistent
+// without concurrent writes.
+func (conn *TCPConn) SerializeTiming() TimingHistogram {
+	var h TimingHistogram
+	for k := range h.Buckets {
+		h.Buckets[k] = atomic.LoadUint64(&conn.serializeTiming[k])
+		h.Count += h.Buckets[k]
+	}
+	h.Total = time.Duration(atomic.LoadInt64(&conn.serializeTotal))
+	return h
+}
+
+// isTransient reports whether a write error is caused by temporary shortage of resource
+func isTransient(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	switch err {
+	case syscall.ENOBUFS, syscall.EAGAIN, syscall.ENOMEM:
+		return true
+	}
+	return false
+}
+
+// Close closes the connection, it may be called concurrently with reads and writes, which return
+// net.ErrClosed once it has begun, and more than once, the calls after the first one return nil.
+// The raw sockets are closed with the flow table held, so no write is in progress on them.
+func (conn *TCPConn) Close() error {
+	var err error
+	conn.dieOnce.Do(func() {
+		// signal closing
+		close(conn.die)
+
+		// tear down peers' state
+		if !conn.silentClose {
+			conn.flowsLock.Lock()
+			for k, v := range conn.flowTable {
+				conn.reset(v, k.addr())
+			}
+			conn.flowsLock.Unlock()
+		}
+
+		// close all established tcp connections
+		if conn.tcpconn != nil { // client
+			setTTL(conn.tcpconn, 64)
+			err = conn.tcpconn.Close()
+		} else {
+			if conn.listener != nil {
+				err = conn.listener.Close() // server
+			}
+			conn.flowsLock.Lock()
+			for k, v := range conn.flowTable {
+				if v.conn != nil {
+					setTTL(v.conn, 64)
+					v.conn.Close()
+				}
+				delete(conn.flowTable, k)
+			}
+			conn.flowsLock.Unlock()
+		}
+
+		// close handles, after the writes in progress, which hold the flow table
+		conn.flowsLock.Lock()
+		for k := range conn.handles {
+			conn.handles[k].Close()
+		}
+		for _, handle := range conn.sendHandles {
+			handle.Close()
+		}
+		conn.flowsLock.Unlock()
+
+		// delete iptable
+		if conn.iptables != nil {
+			releaseRule(conn.iptables, conn.iprule)
+		}
+		if conn.ip6tables != nil {
+			releaseRule(conn.ip6tables, conn.ip6rule)
+		}
+	})
+	return err
+}
+
+// Suppression returns the effective suppression of the packets of the kernel's TCP connections,
+// SuppressTTL if the iptables rules are requested but could not be installed. A listener reports
+// SuppressIPTables if the rule of any address family is in place.
+func (conn *TCPConn) Suppression() Suppression {
+	return conn.suppression
+}
+
+// CloseWithTimeout is like Close, and waits up to d for the goroutines of the connection to
+// exit, like the capture of every raw socket. It returns a timeout error if they have not.
+func (conn *TCPConn) CloseWithTimeout(d time.Duration) error {
+	err := conn.Close()
+	done := make(chan struct{})
+	go func() {
+		conn.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-time.After(d):
+		return errTimeout
+	}
+}
+
+// LocalAddr returns the local network address.
 func (conn *TCPConn) LocalAddr() net.Addr {
 	if conn.tcpconn != nil {
 		return conn.tcpconn.LocalAddr()
-	} else if conn.listener != nil {
-		return conn.listener.Addr()
+	} else if conn.laddr != nil {
+		return conn.laddr
+	}
+	return nil
+}
+
+// Network returns the network of the connection, "tcp4" or "tcp6".
+// For a listener bound to the IPv6 wildcard address, "tcp6" is returned.
+func (conn *TCPConn) Network() string {
+	var ip net.IP
+	if conn.tcpconn != nil {
+		ip = conn.tcpconn.RemoteAddr().(*net.TCPAddr).IP
+	} else if conn.laddr != nil {
+		ip = conn.laddr.IP
+	}
+
+	if ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// SetDeadline implements the Conn SetDeadline method.
+func (conn *TCPConn) SetDeadline(t time.Time) error {
+	if err := conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	if err := conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method,
+// a blocking ReadFrom returns a net.Error with Timeout() == true once t is exceeded.
+func (conn *TCPConn) SetReadDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method,
+// WriteTo waiting for a flow which has not been observed yet, or for the zero window
+// of the peer to reopen, returns a net.Error with Timeout() == true once t is exceeded.
+func (conn *TCPConn) SetWriteDeadline(t time.Time) error {
+	conn.writeDeadline.set(t)
+	return nil
+}
+
+// SetDSCP sets the 6bit DSCP field in IPv4 header of outgoing packets, or in the Traffic Class
+// of IPv6 header, whose ECN bits are cleared.
+func (conn *TCPConn) SetDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return errInvalidDSCP
+	}
+	for k := range conn.handles {
+		if err := setTOS(conn.sender(conn.handles[k]), dscp<<2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetTrafficClass sets the 8bit Traffic Class in IPv6 header of outgoing packets,
+// it has no effect on IPv4.
+func (conn *TCPConn) SetTrafficClass(tc uint8) error {
+	for k := range conn.handles {
+		if conn.handles[k].LocalAddr().(*net.IPAddr).IP.To4() == nil {
+			if err := setTOS(conn.sender(conn.handles[k]), int(tc)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetFlowLabel sets the 20bit Flow Label in IPv6 header of outgoing packets, 0 disables it,
+// it has no effect on IPv4. The label is leased from the kernel for each raw socket.
+func (conn *TCPConn) SetFlowLabel(fl uint32) error {
+	if fl > 0xfffff {
+		return errInvalidFlowLabel
+	}
+	old := atomic.LoadUint32(&conn.flowLabel)
+	for k := range conn.handles {
+		if conn.handles[k].LocalAddr().(*net.IPAddr).IP.To4() == nil {
+			if err := setFlowLabel(conn.sender(conn.handles[k]), old, fl); err != nil {
+				return err
+			}
+		}
+	}
+	atomic.StoreUint32(&conn.flowLabel, fl)
+	return nil
+}
+
+// SetTTL sets the Time-To-Live field in IPv4 header, or Hop Limit in IPv6 header of outgoing packets.
+func (conn *TCPConn) SetTTL(ttl int) error {
+	if ttl < 1 || ttl > 255 {
+		return errInvalidTTL
+	}
+	for k := range conn.handles {
+		if err := setHopLimit(conn.sender(conn.handles[k]), ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetWindow sets the window advertised in outgoing segments, default to 65535.
+// A stable window looks like a regular TCP connection to stateful firewalls.
+func (conn *TCPConn) SetWindow(window uint16) {
+	atomic.StoreUint32(&conn.window, uint32(window))
+}
+
+// SetReadBuffer sets the size of the operating system's receive buffer associated with the connection,
+// on every raw socket capturing for it, Options.ReadBuffer sets it on creation. The kernel caps
+// the size at net.core.rmem_max, the drops of a buffer too small are counted in SocketStats.
+func (conn *TCPConn) SetReadBuffer(bytes int) error {
+	var err error
+	for k := range conn.handles {
+		if err := conn.handles[k].SetReadBuffer(bytes); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// SetWriteBuffer sets the size of the operating system's transmit buffer associated with the connection.
+func (conn *TCPConn) SetWriteBuffer(bytes int) error {
+	var err error
+	for k := range conn.handles {
+		if err := conn.sender(conn.handles[k]).SetWriteBuffer(bytes); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// SetBPFFilter attaches a classic BPF program to every raw socket of this connection,
+// replacing the one attached before, including the default destination port filter,
+// an empty filter detaches it.
+// The program sees IPv4 packets from the IP header, and IPv6 packets from the TCP header.
+// Packets already queued on the sockets may still be delivered under the old filter.
+func (conn *TCPConn) SetBPFFilter(filter []bpf.Instruction) error {
+	var prog []syscall.SockFilter
+	if len(filter) > 0 {
+		raw, err := bpf.Assemble(filter)
+		if err != nil {
+			return err
+		}
+		prog = toSockFilter(raw)
+	}
+
+	conn.filterLock.Lock()
+	defer conn.filterLock.Unlock()
+	for k := range conn.handles {
+		if err := setBPF(conn.handles[k], prog); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Available reports whether connections can be created, which needs raw IP sockets,
+// the error tells missing privilege apart from missing kernel support.
+// iptables is optional, except for ListenRaw.
+func Available() (bool, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+	switch err {
+	case nil:
+		syscall.Close(fd)
+		return true, nil
+	case syscall.EPERM, syscall.EACCES:
+		return false, errNoPrivilege
+	case syscall.EAFNOSUPPORT, syscall.EPROTONOSUPPORT, syscall.ESOCKTNOSUPPORT:
+		return false, errNoRawSupport
+	default:
+		return false, os.NewSyscallError("socket", err)
+	}
+}
+
+// Dial connects to the remote TCP port,
+// and returns a single packet-oriented connection
+func Dial(network, address string) (*TCPConn, error) {
+	return dial(context.Background(), network, "", address, nil, nil)
+}
+
+// DialContext is like Dial, but the address resolution and the connection setup are
+// aborted once ctx is done, every resource opened so far is released, and ctx.Err() is returned.
+func DialContext(ctx context.Context, network, address string) (*TCPConn, error) {
+	return dial(ctx, network, "", address, nil, nil)
+}
+
+// DialTimeout is like Dial, but the setup is aborted after timeout, like DialContext with a deadline.
+func DialTimeout(network, address string, timeout time.Duration) (*TCPConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return dial(ctx, network, "", address, nil, nil)
+}
+
+// DialFrom is like Dial, but the system TCP connection originates from localAddr, the port
+// of which is bound exactly, an error is returned if it's in use. A port of 0 picks an
+// ephemeral one, and an empty host leaves the source address to the routing table.
+func DialFrom(network, localAddr, remoteAddr string) (*TCPConn, error) {
+	return dial(context.Background(), network, localAddr, remoteAddr, nil, nil)
+}
+
+// DialWithOptions is like Dial, with the tunables in opts, a nil opts is the default.
+func DialWithOptions(network, address string, opts *Options) (*TCPConn, error) {
+	return dial(context.Background(), network, "", address, nil, opts)
+}
+
+// DialOnInterface is like Dial, but both the system TCP connection and the raw socket
+// are bound to the network interface named iface, skipping the route based selection.
+// An empty iface falls back to Dial.
+func DialOnInterface(network, address, iface string) (*TCPConn, error) {
+	return dial(context.Background(), network, "", address, nil, &Options{Interface: iface})
+}
+
+// DialFD is like Dial, but the packets are sent and captured through an already opened
+// raw IP socket (AF_INET/AF_INET6, SOCK_RAW, IPPROTO_TCP), for example one passed from a
+// privileged helper process. The socket must be bound to the local address towards the
+// remote, fd is duplicated, so the caller keeps the ownership of it.
+//
+// Without privilege, the iptables rules cannot be installed, and the kernel's own ACKs are
+// only suppressed by the TTL.
+func DialFD(fd int, network, address string) (*TCPConn, error) {
+	handle, err := fileIPConn(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dial(context.Background(), network, "", address, handle, nil)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialWithHandle is like Dial, but the packets are sent and captured through handle, a raw IP
+// socket opened and configured by the caller, like with a specific receive buffer. The socket
+// must be bound to the local address towards the remote, and is owned by the connection once
+// it is returned, Close closes it. The BPF filter of the local port is attached to it, and
+// detached on error, the caller keeps the handle then.
+func DialWithHandle(handle *net.IPConn, network, address string) (*TCPConn, error) {
+	if err := checkHandle(handle); err != nil {
+		return nil, err
+	}
+	return dial(context.Background(), network, "", address, handle, nil)
+}
+
+// Dial is like the package Dial, with the configuration of d.
+func (d *Dialer) Dial(network, address string) (*TCPConn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like the package DialContext, with the configuration of d.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (*TCPConn, error) {
+	conn, err := dial(ctx, network, d.LocalAddr, address, nil, &d.Options)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.configure(d.TTL, d.Window); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Listen is like the package ListenContext, or ListenRaw if lc.Raw is set, with the configuration of lc.
+func (lc *ListenConfig) Listen(ctx context.Context, network, address string) (*TCPConn, error) {
+	conn, err := listen(ctx, network, address, lc.Raw, nil, false, &lc.Options)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.configure(lc.TTL, lc.Window); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// configure applies the settings of a Dialer or ListenConfig, zero values are left as default
+func (conn *TCPConn) configure(ttl int, window uint16) error {
+	if ttl != 0 {
+		if err := conn.SetTTL(ttl); err != nil {
+			return err
+		}
+	}
+	if window != 0 {
+		conn.SetWindow(window)
+	}
+	return nil
+}
+
+// fileIPConn creates a raw IP socket from a duplicate of fd
+func fileIPConn(fd int) (*net.IPConn, error) {
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(dup), "tcpraw")
+	defer f.Close()
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, ok := pc.(*net.IPConn)
+	if !ok {
+		pc.Close()
+		return nil, errNotRawSocket
+	}
+	if err := checkHandle(handle); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return handle, nil
+}
+
+// checkHandle makes sure a raw IP socket of the caller is bound to a local address
+func checkHandle(handle *net.IPConn) error {
+	if handle == nil {
+		return errNoHandle
+	}
+	if laddr, ok := handle.LocalAddr().(*net.IPAddr); !ok || laddr.IP.IsUnspecified() {
+		return errUnbound
+	}
+	return nil
+}
+
+// dial creates a connection to address from local if not empty, with the raw socket opened by net.DialIP if handle is nil
+func dial(ctx context.Context, network, local, address string, handle *net.IPConn, opts *Options) (_ *TCPConn, err error) {
+	// remote address resolve
+	raddr, err := resolveTCPAddr(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	var laddr *net.TCPAddr
+	if local != "" {
+		if laddr, err = resolveTCPAddr(ctx, network, local); err != nil {
+			return nil, err
+		}
+	}
+
+	if name := opts.iface(); name != "" {
+		if _, err := net.InterfaceByName(name); err != nil {
+			ifaces, _ := net.Interfaces()
+			return nil, &InterfaceNotFoundError{Network: network, Addr: raddr.IP, Interface: name, Scanned: scanInterfaces(ifaces)}
+		}
+	}
+	ctrl := bindDevice(opts.iface())
+	keep := handle != nil // the caller's handle
+	if handle == nil {
+		// AF_INET
+		dialer := net.Dialer{Control: ctrl}
+		if laddr != nil && laddr.IP != nil && !laddr.IP.IsUnspecified() {
+			dialer.LocalAddr = &net.IPAddr{IP: laddr.IP, Zone: laddr.Zone}
+		}
+		remote := &net.IPAddr{IP: raddr.IP, Zone: raddr.Zone}
+		var c net.Conn
+		c, err = dialIP(ctx, &dialer, remote)
+		if err != nil && ctx.Err() == nil && ctrl == nil && dialer.LocalAddr == nil {
+			// without a route, an address on the link of the remote is taken, on its interface,
+			// and the kernel assumes the remote on link for a socket bound to the device
+			if ifi, ip := onLink(remote); ifi != nil {
+				ctrl = bindDevice(ifi.Name)
+				dialer = net.Dialer{Control: ctrl, LocalAddr: ip}
+				c, err = dialIP(ctx, &dialer, remote)
+			}
+		}
+		if err != nil {
+			return nil, ctxErr(ctx, fmt.Errorf("selecting the local address towards %v by the routing table: %w", raddr.IP, err))
+		}
+		handle = c.(*net.IPConn)
+	} else {
+		// the system TCP connection must originate from the address of raw socket
+		if laddr == nil {
+			laddr = new(net.TCPAddr)
+		}
+		laddr.IP = handle.LocalAddr().(*net.IPAddr).IP
 	}
-	return nil
+
+	// fields
+	conn := new(TCPConn)
+	conn.die = make(chan struct{})
+	conn.flowTable = make(map[flowKey]*tcpFlow)
+	conn.chMessage = make(chan message, opts.queueDepth())
+	conn.silentClose = opts.silent()
+	conn.retryWrites = opts.retries()
+	conn.snapLen = opts.snapLen()
+	conn.fragment = opts.fragment()
+	conn.dynamicWindow = opts.dynamicWindow()
+	conn.checksumOffload = opts.checksumOffload()
+	conn.stealth = opts.stealthMode()
+	if conn.stealth {
+		conn.timestamps = 1
+	}
+	conn.window = defaultWindow
+	conn.readDeadline = makeDeadline()
+	conn.writeDeadline = makeDeadline()
+	conn.handles = append(conn.handles, handle)
+	defer func() {
+		if err != nil { // release what has been opened, the capture is started by the dialer
+			conn.abort(keep)
+		}
+	}()
+	conn.loadMTU()
+	if err = conn.openSendHandles(ctx, opts.sendIface()); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	conn.opts = gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	// create an established tcp connection
+	// will hack this tcp connection for packet transmission
+	//
+	// the socket is bound before connecting, so that the capture on the local port
+	// starts in time to observe the SYN-ACK, which carries both initial sequence numbers
+	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		if ctrl != nil {
+			if err := ctrl(network, address, c); err != nil {
+				return err
+			}
+		}
+		lport, err := bindLocal(c, laddr, raddr.IP)
+		if err != nil {
+			return err
+		}
+		if err := setBPFPort(handle, lport, opts.bpfFilter()); err != nil {
+			return err
+		}
+		if bytes := opts.readBuffer(); bytes > 0 {
+			if err := handle.SetReadBuffer(bytes); err != nil {
+				return err
+			}
+		}
+		if conn.fragment {
+			if err := setFragment(conn.sender(handle)); err != nil {
+				return err
+			}
+		}
+		if conn.checksumOffload {
+			if err := setChecksumOffload(conn.sender(handle)); err != nil {
+				return err
+			}
+		}
+		conn.wg.Add(1)
+		go conn.captureFlow(handle, lport)
+		return nil
+	}}
+	c, err := dialer.DialContext(ctx, network, raddr.String())
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	tcpconn := c.(*net.TCPConn)
+	conn.tcpconn = tcpconn
+	peerScale, localScale, scaled := windowScales(tcpconn)
+	conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) {
+		e.conn = tcpconn
+		if scaled {
+			e.peerScale, e.localScale = peerScale, localScale
+		}
+		if e.handle == nil { // SYN-ACK not captured
+			close(e.ready)
+		}
+		e.handle = handle
+	})
+
+	// iptables
+	conn.suppression = opts.suppression()
+	if conn.suppression != SuppressNone {
+		if err = setTTL(tcpconn, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	if conn.suppression == SuppressIPTables {
+		// the rules match the local port as well, so the dials to the same remote own a rule each,
+		// and closing one of them leaves the others suppressed
+		lport := fmt.Sprint(tcpconn.LocalAddr().(*net.TCPAddr).Port)
+		var ruled bool // the rule of the remote's family is in place
+		if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4); err == nil {
+			rule := []string{"-m", "ttl", "--ttl-eq", "1", "-p", "tcp", "--sport", lport, "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
+			owned, exists := acquireRule(ipt, rule)
+			if owned {
+				conn.iprule = rule
+				conn.iptables = ipt
+			}
+			ruled = ruled || (exists && raddr.IP.To4() != nil)
+		}
+		if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err == nil {
+			rule := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "--sport", lport, "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
+			owned, exists := acquireRule(ipt, rule)
+			if owned {
+				conn.ip6rule = rule
+				conn.ip6tables = ipt
+			}
+			ruled = ruled || (exists && raddr.IP.To4() == nil)
+		}
+		if !ruled {
+			conn.suppression = SuppressTTL
+		}
+	}
+
+	// discard everything
+	conn.wg.Add(1)
+	go conn.discard(tcpconn)
+
+	if conn.keepAlive = opts.keepAlive(); conn.keepAlive > 0 {
+		conn.wg.Add(1)
+		go conn.keepalive()
+	}
+	if interval := opts.addressCheck(); interval > 0 {
+		conn.wg.Add(1)
+		go conn.watchAddresses(interval)
+	}
+
+	return conn, nil
 }
 
-// SetDeadline implements the Conn SetDeadline method.
-func (conn *TCPConn) SetDeadline(t time.Time) error {
-	if err := conn.SetReadDeadline(t); err != nil {
-		return err
+// Listen acts like net.ListenTCP,
+// and returns a single packet-oriented connection.
+//
+// Every Listen opens its own raw sockets on the local addresses, with a socket filter
+// matching the listening port attached, so multiple listeners on the same interface
+// are demultiplexed by the kernel rather than processing each other's packets.
+// A wildcard address of network "tcp" serves both IPv4 and IPv6 peers, every flow
+// replies through the raw socket it's captured on, so in the address family of the peer.
+func Listen(network, address string) (*TCPConn, error) {
+	return listen(context.Background(), network, address, false, nil, false, nil)
+}
+
+// ListenContext is like Listen, but the setup is aborted once ctx is done,
+// every resource opened so far is released, and ctx.Err() is returned.
+func ListenContext(ctx context.Context, network, address string) (*TCPConn, error) {
+	return listen(ctx, network, address, false, nil, false, nil)
+}
+
+// ListenWithOptions is like Listen, with the tunables in opts, a nil opts is the default.
+func ListenWithOptions(network, address string, opts *Options) (*TCPConn, error) {
+	return listen(context.Background(), network, address, false, nil, false, opts)
+}
+
+// ListenOnInterface is like Listen, but captures only on the addresses of the network
+// interface named iface, with the sockets bound to it. An empty iface falls back to Listen.
+func ListenOnInterface(network, address, iface string) (*TCPConn, error) {
+	return listen(context.Background(), network, address, false, nil, false, &Options{Interface: iface})
+}
+
+// ListenFD is like Listen, but the packets are sent and captured through already opened
+// raw IP sockets, for example ones passed from a privileged helper process. Every socket
+// must be bound to a local address the listener serves, fds are duplicated, so the caller
+// keeps the ownership of them.
+func ListenFD(fds []int, network, address string) (*TCPConn, error) {
+	var handles []*net.IPConn
+	for _, fd := range fds {
+		handle, err := fileIPConn(fd)
+		if err != nil {
+			for k := range handles {
+				handles[k].Close()
+			}
+			return nil, err
+		}
+		handles = append(handles, handle)
 	}
-	if err := conn.SetWriteDeadline(t); err != nil {
-		return err
+
+	// the duplicates are closed by listen on error
+	return listen(context.Background(), network, address, false, handles, false, nil)
+}
+
+// ListenWithHandle is like Listen, but the packets are sent and captured through handle, a raw
+// IP socket opened and configured by the caller. The socket must be bound to the local address
+// the listener serves, and is owned by the listener once it is returned, Close closes it,
+// the caller keeps it on error.
+func ListenWithHandle(handle *net.IPConn, network, address string) (*TCPConn, error) {
+	if err := checkHandle(handle); err != nil {
+		return nil, err
 	}
-	return nil
+	return listen(context.Background(), network, address, false, []*net.IPConn{handle}, true, nil)
 }
 
-// SetReadDeadline implements the Conn SetReadDeadline method.
-func (conn *TCPConn) SetReadDeadline(t time.Time) error {
-	conn.readDeadline.Store(t)
-	return nil
+// ListenRaw is like Listen, but no system TCP listener is created, handshakes are
+// answered by the listener itself with crafted SYN-ACKs, and flows are established
+// on the final ACK. Half-open flows are expired 30 seconds after their last SYN.
+//
+// The address must carry an explicit port, and iptables must be available to drop the
+// RSTs which the kernel sends in reply to segments of a port without a socket.
+func ListenRaw(network, address string) (*TCPConn, error) {
+	return listen(context.Background(), network, address, true, nil, false, nil)
 }
 
-// SetWriteDeadline implements the Conn SetWriteDeadline method.
-func (conn *TCPConn) SetWriteDeadline(t time.Time) error {
-	conn.writeDeadline.Store(t)
-	return nil
+// listen creates a listener on address, with raw sockets opened on the local addresses if handles is nil,
+// the caller keeps handles on error if keep
+func listen(ctx context.Context, network, address string, raw bool, handles []*net.IPConn, keep bool, opts *Options) (_ *TCPConn, err error) {
+	// fields
+	conn := new(TCPConn)
+	conn.flowTable = make(map[flowKey]*tcpFlow)
+	conn.die = make(chan struct{})
+	defer func() {
+		if err != nil { // release what has been opened
+			conn.abort(keep)
+		}
+	}()
+	conn.chMessage = make(chan message, opts.queueDepth())
+	conn.chAccept = make(chan *PeerConn, acceptBacklog)
+	conn.silentClose = opts.silent()
+	conn.retryWrites = opts.retries()
+	conn.snapLen = opts.snapLen()
+	conn.fragment = opts.fragment()
+	conn.dynamicWindow = opts.dynamicWindow()
+	conn.checksumOffload = opts.checksumOffload()
+	conn.stealth = opts.stealthMode()
+	if conn.stealth {
+		conn.timestamps = 1
+	}
+	conn.window = defaultWindow
+	conn.readDeadline = makeDeadline()
+	conn.writeDeadline = makeDeadline()
+	conn.opts = gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	// resolve address
+	laddr, err := resolveTCPAddr(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if raw && laddr.Port == 0 {
+		return nil, errNoPort
+	}
+
+	// AF_INET
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	all := ifaces
+	if name := opts.iface(); name != "" { // capture on the specified iface only
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, &InterfaceNotFoundError{Network: network, Addr: laddr.IP, Interface: name, Scanned: scanInterfaces(all)}
+		}
+		ifaces = []net.Interface{*iface}
+	}
+
+	if handles != nil {
+		conn.handles = handles
+	} else if laddr.IP == nil || laddr.IP.IsUnspecified() { // if address is not specified, capture on all ifaces
+		var lasterr error // nil while no address of the family is found
+		for _, iface := range ifaces {
+			if addrs, err := iface.Addrs(); err == nil {
+				for _, addr := range addrs {
+					if ipaddr, ok := addr.(*net.IPNet); ok {
+						// only the addresses of the listening family
+						if (network == "tcp4" && ipaddr.IP.To4() == nil) || (network == "tcp6" && ipaddr.IP.To4() != nil) {
+							continue
+						}
+
+						// link-local IPv6 addresses are only valid with a zone
+						ip := &net.IPAddr{IP: ipaddr.IP}
+						if ip.IP.To4() == nil && ip.IP.IsLinkLocalUnicast() {
+							ip.Zone = iface.Name
+						}
+
+						if handle, err := listenIP(ctx, ip, opts.iface()); err == nil {
+							conn.handles = append(conn.handles, handle)
+						} else {
+							lasterr = err
+						}
+					}
+				}
+			}
+		}
+		if len(conn.handles) == 0 {
+			if lasterr == nil {
+				lasterr = &InterfaceNotFoundError{Network: network, Addr: laddr.IP, Interface: opts.iface(), Scanned: scanInterfaces(ifaces)}
+			}
+			return nil, ctxErr(ctx, lasterr)
+		}
+	} else {
+		if handle, err := listenIP(ctx, &net.IPAddr{IP: laddr.IP, Zone: laddr.Zone}, opts.iface()); err == nil {
+			conn.handles = append(conn.handles, handle)
+		} else {
+			return nil, ctxErr(ctx, err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if raw {
+		conn.raw = true
+		conn.synTable = make(map[flowKey]*halfOpenFlow)
+	} else {
+		// start listening
+		lc := net.ListenConfig{Control: bindDevice(opts.iface())}
+		if opts.reusePort() {
+			conn.reusePort = true
+			lc.Control = reusePort(lc.Control)
+		}
+		l, err := lc.Listen(ctx, network, laddr.String())
+		if err != nil {
+			return nil, ctxErr(ctx, err)
+		}
+
+		conn.listener = l.(*net.TCPListener)
+		laddr = l.Addr().(*net.TCPAddr)
+	}
+	conn.laddr = laddr
+
+	// start capturing, every raw socket only queues segments destined to our port,
+	// so listeners on different ports of the same interface never see each other's traffic
+	conn.loadMTU()
+	if err := conn.openSendHandles(ctx, opts.sendIface()); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	for _, handle := range conn.handles {
+		if err := setBPFPort(handle, laddr.Port, opts.bpfFilter()); err != nil {
+			return nil, err
+		}
+		if bytes := opts.readBuffer(); bytes > 0 {
+			if err := handle.SetReadBuffer(bytes); err != nil {
+				return nil, err
+			}
+		}
+		if conn.fragment {
+			if err := setFragment(conn.sender(handle)); err != nil {
+				return nil, err
+			}
+		}
+		if conn.checksumOffload {
+			if err := setChecksumOffload(conn.sender(handle)); err != nil {
+				return nil, err
+			}
+		}
+		conn.wg.Add(1)
+		go conn.captureFlow(handle, laddr.Port)
+	}
+
+	// start cleaner
+	conn.flowTimeout = opts.flowTimeout()
+	conn.wg.Add(1)
+	go conn.cleaner()
+
+	if conn.keepAlive = opts.keepAlive(); conn.keepAlive > 0 {
+		conn.wg.Add(1)
+		go conn.keepalive()
+	}
+	if interval := opts.addressCheck(); interval > 0 {
+		conn.wg.Add(1)
+		go conn.watchAddresses(interval)
+	}
+
+	// iptables drop packets marked with TTL = 1, or RSTs from kernel in raw mode
+	// TODO: what if iptables is not available, the next hop will send back ICMP Time Exceeded,
+	// is this still an acceptable behavior?
+	rule := []string{"-m", "ttl", "--ttl-eq", "1", "-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
+	rule6 := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
+	conn.suppression = opts.suppression()
+	if raw {
+		rule = []string{"-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "--tcp-flags", "RST", "RST", "-j", "DROP"}
+		rule6 = rule
+		conn.suppression = SuppressIPTables
+	}
+	var ruled bool // a rule is in place
+	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4); err == nil && conn.suppression == SuppressIPTables {
+		owned, exists := acquireRule(ipt, rule)
+		if owned {
+			conn.iprule = rule
+			conn.iptables = ipt
+		}
+		ruled = ruled || exists
+	}
+	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err == nil && conn.suppression == SuppressIPTables {
+		owned, exists := acquireRule(ipt, rule6)
+		if owned {
+			conn.ip6rule = rule6
+			conn.ip6tables = ipt
+		}
+		ruled = ruled || exists
+	}
+	if conn.suppression == SuppressIPTables && !ruled {
+		conn.suppression = SuppressTTL
+	}
+
+	if raw {
+		if conn.iptables == nil && conn.ip6tables == nil {
+			return nil, errNoSuppression
+		}
+		return conn, nil
+	}
+
+	// discard everything in original connection
+	conn.wg.Add(1)
+	go func() {
+		defer conn.wg.Done()
+		for {
+			tcpconn, err := conn.listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+
+			// if we cannot set TTL = 1, the only thing reasonable is panic
+			if conn.suppression != SuppressNone {
+				if err := setTTL(tcpconn, 1); err != nil {
+					panic(err)
+				}
+			}
+
+			conn.accepted(tcpconn)
+
+			// discard everything
+			conn.wg.Add(1)
+			go conn.discard(tcpconn)
+		}
+	}()
+
+	return conn, nil
 }
 
-// SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
-func (conn *TCPConn) SetDSCP(dscp int) error {
-	for k := range conn.handles {
-		if err := setDSCP(conn.handles[k], dscp); err != nil {
-			return err
+// accepted records the connection returned by the system listener in its flow, a previous connection
+// from the same address is over, and handles again the segments held since its SYN
+func (conn *TCPConn) accepted(tcpconn *net.TCPConn) {
+	peerScale, localScale, scaled := windowScales(tcpconn)
+	var held []heldSegment
+	conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) {
+		if e.conn != nil {
+			e.conn.Close()
 		}
+		e.conn = tcpconn
+		if scaled {
+			e.peerScale, e.localScale = peerScale, localScale
+		}
+		held, e.held = e.held, nil
+	})
+	for _, h := range held {
+		conn.handleSegment(h.handle, h.segment, h.from, conn.localPort())
 	}
-	return nil
 }
 
-// SetReadBuffer sets the size of the operating system's receive buffer associated with the connection.
-func (conn *TCPConn) SetReadBuffer(bytes int) error {
-	var err error
-	for k := range conn.handles {
-		if err := conn.handles[k].SetReadBuffer(bytes); err != nil {
-			return err
+// Interfaces returns the interfaces which are up, with an address of the family of target,
+// for DialOnInterface and Options.Interface. The interface selected by the routing table for
+// target, which Dial captures on, comes first with Routed set. Target is an address like the
+// one of Dial, or a host without a port.
+func Interfaces(target string) ([]InterfaceInfo, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "0")
+	}
+	raddr, err := resolveTCPAddr(context.Background(), "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	if raddr.IP == nil {
+		return nil, errNoTarget
+	}
+
+	// the source address of the route, connecting a UDP socket sends nothing
+	var routed *net.Interface
+	if c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: raddr.IP, Port: 9, Zone: raddr.Zone}); err == nil {
+		laddr := c.LocalAddr().(*net.UDPAddr)
+		routed = interfaceOf(&net.IPAddr{IP: laddr.IP, Zone: laddr.Zone})
+		c.Close()
+	} else {
+		routed, _ = onLink(&net.IPAddr{IP: raddr.IP, Zone: raddr.Zone}) // no route, like dial, the interface on the link of target
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var infos []InterfaceInfo
+	for k := range ifaces {
+		ifi := &ifaces[k]
+		if ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		info := InterfaceInfo{Name: ifi.Name, LinkType: linkTypeOf(ifi), Routed: routed != nil && routed.Index == ifi.Index}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && (ipnet.IP.To4() != nil) == (raddr.IP.To4() != nil) {
+				info.Addrs = append(info.Addrs, ipnet)
+			}
+		}
+		if len(info.Addrs) == 0 {
+			continue
+		}
+		if info.Routed {
+			infos = append([]InterfaceInfo{info}, infos...)
+		} else {
+			infos = append(infos, info)
 		}
 	}
-	return err
+	return infos, nil
 }
 
-// SetWriteBuffer sets the size of the operating system's transmit buffer associated with the connection.
-func (conn *TCPConn) SetWriteBuffer(bytes int) error {
-	var err error
-	for k := range conn.handles {
-		if err := conn.handles[k].SetWriteBuffer(bytes); err != nil {
-			return err
+// interfaceOf returns the interface which owns addr, or nil if not found
+func interfaceOf(addr *net.IPAddr) *net.Interface {
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			return ifi
+		}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for k := range ifaces {
+		addrs, err := ifaces[k].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(addr.IP) {
+				return &ifaces[k]
+			}
+		}
+	}
+	return nil
+}
+
+// onLink returns the first interface which is up with a subnet containing addr, and its address
+// in the subnet, or nil if addr is on none of the links. The interface of a zoned addr is the zone,
+// a link-local addr without a zone is on no link, as every interface has the subnet.
+func onLink(addr *net.IPAddr) (*net.Interface, *net.IPAddr) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil
+	}
+	if addr.Zone == "" && addr.IP.IsLinkLocalUnicast() {
+		return nil, nil
+	}
+	for k := range ifaces {
+		if ifaces[k].Flags&net.FlagUp == 0 || (addr.Zone != "" && addr.Zone != ifaces[k].Name && addr.Zone != strconv.Itoa(ifaces[k].Index)) {
+			continue
+		}
+		addrs, err := ifaces[k].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.Contains(addr.IP) {
+				local := &net.IPAddr{IP: ipnet.IP}
+				if addr.Zone != "" && local.IP.IsLinkLocalUnicast() {
+					local.Zone = addr.Zone
+				}
+				return &ifaces[k], local
+			}
 		}
 	}
-	return err
+	return nil, nil
 }
 
-// Dial connects to the remote TCP port,
-// and returns a single packet-oriented connection
-func Dial(network, address string) (*TCPConn, error) {
-	// remote address resolve
-	raddr, err := net.ResolveTCPAddr(network, address)
-	if err != nil {
-		return nil, err
+// linkTypeOf returns the link layer of ifi
+func linkTypeOf(ifi *net.Interface) LinkType {
+	switch {
+	case ifi == nil:
+		return LinkUnknown
+	case ifi.Flags&net.FlagLoopback != 0:
+		return LinkLoopback
+	case len(ifi.HardwareAddr) == 6:
+		return LinkEthernet
 	}
+	return LinkRaw
+}
 
-	// AF_INET
-	handle, err := net.DialIP("ip:tcp", nil, &net.IPAddr{IP: raddr.IP})
-	if err != nil {
-		return nil, err
+// openSendHandles opens a raw socket for sending on the address of every handle, bound to the
+// network interface iface, nothing is opened if iface is empty. The sockets capture nothing.
+func (conn *TCPConn) openSendHandles(ctx context.Context, iface string) error {
+	if iface == "" {
+		return nil
 	}
-
-	// create an established tcp connection
-	// will hack this tcp connection for packet transmission
-	tcpconn, err := net.DialTCP(network, nil, raddr)
+	ifi, err := net.InterfaceByName(iface)
 	if err != nil {
-		return nil, err
-	}
-
-	// fields
-	conn := new(TCPConn)
-	conn.die = make(chan struct{})
-	conn.flowTable = make(map[string]*tcpFlow)
-	conn.tcpconn = tcpconn
-	conn.chMessage = make(chan message)
-	conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) { e.conn = tcpconn })
-	conn.handles = append(conn.handles, handle)
-	conn.opts = gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+		return err
 	}
-	go conn.captureFlow(handle, tcpconn.LocalAddr().(*net.TCPAddr).Port)
-	go conn.cleaner()
-
-	// iptables
-	err = setTTL(tcpconn, 1)
+	dropAll, err := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0}})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4); err == nil {
-		rule := []string{"-m", "ttl", "--ttl-eq", "1", "-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.iprule = rule
-					conn.iptables = ipt
-				}
+	sendHandles := make(map[*net.IPConn]*net.IPConn)
+	for _, handle := range conn.handles {
+		send, err := listenIP(ctx, handle.LocalAddr().(*net.IPAddr), iface)
+		if err == nil {
+			if err = setBPF(send, toSockFilter(dropAll)); err != nil {
+				send.Close()
 			}
 		}
-	}
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err == nil {
-		rule := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.ip6rule = rule
-					conn.ip6tables = ipt
-				}
+		if err != nil {
+			for _, send := range sendHandles {
+				send.Close()
 			}
+			return err
 		}
+		sendHandles[handle] = send
 	}
+	conn.sendHandles = sendHandles
 
-	// discard everything
-	go io.Copy(ioutil.Discard, tcpconn)
-
-	return conn, nil
-}
-
-// Listen acts like net.ListenTCP,
-// and returns a single packet-oriented connection
-func Listen(network, address string) (*TCPConn, error) {
-	// fields
-	conn := new(TCPConn)
-	conn.flowTable = make(map[string]*tcpFlow)
-	conn.die = make(chan struct{})
-	conn.chMessage = make(chan message)
-	conn.opts = gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+	// the payloads fit both the interface captured on and the one sent on
+	for handle := range sendHandles {
+		if n := conn.mtu[handle]; n == 0 || ifi.MTU < n {
+			conn.mtu[handle] = ifi.MTU
+		}
 	}
+	return nil
+}
 
-	// resolve address
-	laddr, err := net.ResolveTCPAddr(network, address)
-	if err != nil {
-		return nil, err
+// sender returns the handle sending the segments of the flows captured on handle
+func (conn *TCPConn) sender(handle *net.IPConn) *net.IPConn {
+	if send := conn.sendHandles[handle]; send != nil {
+		return send
 	}
+	return handle
+}
 
-	// AF_INET
-	ifaces, err := net.Interfaces()
+// listenIP opens a raw socket on addr, bound to the network interface iface if not empty
+func listenIP(ctx context.Context, addr *net.IPAddr, iface string) (*net.IPConn, error) {
+	lc := net.ListenConfig{Control: bindDevice(iface)}
+	c, err := lc.ListenPacket(ctx, "ip:tcp", addr.String())
 	if err != nil {
 		return nil, err
 	}
+	return c.(*net.IPConn), nil
+}
 
-	if laddr.IP == nil || laddr.IP.IsUnspecified() { // if address is not specified, capture on all ifaces
-		var lasterr error
-		for _, iface := range ifaces {
-			if addrs, err := iface.Addrs(); err == nil {
-				for _, addr := range addrs {
-					if ipaddr, ok := addr.(*net.IPNet); ok {
-						if handle, err := net.ListenIP("ip:tcp", &net.IPAddr{IP: ipaddr.IP}); err == nil {
-							conn.handles = append(conn.handles, handle)
-							go conn.captureFlow(handle, laddr.Port)
-						} else {
-							lasterr = err
-						}
-					}
+// bindLocal binds a socket to laddr, an ephemeral port is chosen if the port is 0, the wildcard
+// address of the family of raddr is used if laddr is nil or without IP, and returns the port
+func bindLocal(c syscall.RawConn, laddr *net.TCPAddr, raddr net.IP) (port int, err error) {
+	var sa syscall.Sockaddr
+	if raddr.To4() != nil {
+		sa4 := &syscall.SockaddrInet4{}
+		if laddr != nil {
+			copy(sa4.Addr[:], laddr.IP.To4())
+			sa4.Port = laddr.Port
+		}
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{}
+		if laddr != nil {
+			copy(sa6.Addr[:], laddr.IP.To16())
+			sa6.Port = laddr.Port
+			if laddr.Zone != "" {
+				if ifi, err := net.InterfaceByName(laddr.Zone); err == nil {
+					sa6.ZoneId = uint32(ifi.Index)
 				}
 			}
 		}
-		if len(conn.handles) == 0 {
-			return nil, lasterr
+		sa = sa6
+	}
+
+	cerr := c.Control(func(fd uintptr) {
+		if err = syscall.Bind(int(fd), sa); err != nil {
+			err = os.NewSyscallError("bind", err)
+			return
 		}
-	} else {
-		if handle, err := net.ListenIP("ip:tcp", &net.IPAddr{IP: laddr.IP}); err == nil {
-			conn.handles = append(conn.handles, handle)
-			go conn.captureFlow(handle, laddr.Port)
-		} else {
-			return nil, err
+		var bound syscall.Sockaddr
+		if bound, err = syscall.Getsockname(int(fd)); err != nil {
+			err = os.NewSyscallError("getsockname", err)
+			return
 		}
+		switch bound := bound.(type) {
+		case *syscall.SockaddrInet4:
+			port = bound.Port
+		case *syscall.SockaddrInet6:
+			port = bound.Port
+		}
+	})
+	if cerr != nil {
+		return 0, cerr
 	}
+	return port, err
+}
 
-	// start listening
-	l, err := net.ListenTCP(network, laddr)
+// resolveTCPAddr is like net.ResolveTCPAddr, with the lookups bounded by ctx
+func resolveTCPAddr(ctx context.Context, network, address string) (*net.TCPAddr, error) {
+	host, service, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
 	}
+	port, err := net.DefaultResolver.LookupPort(ctx, network, service)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	if host == "" {
+		return &net.TCPAddr{Port: port}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	// prefer IPv4 like net.ResolveTCPAddr
+	var addr *net.IPAddr
+	for k := range ips {
+		ip := &ips[k]
+		switch {
+		case ip.IP.To4() != nil && network != "tcp6":
+			return &net.TCPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}, nil
+		case ip.IP.To4() == nil && network != "tcp4" && addr == nil:
+			addr = ip
+		}
+	}
+	if addr == nil {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return &net.TCPAddr{IP: addr.IP, Port: port, Zone: addr.Zone}, nil
+}
 
-	conn.listener = l
+// ctxErr returns ctx.Err() if ctx is done, err otherwise, since the errors of
+// the net package do not tell a cancelled context apart
+func ctxErr(ctx context.Context, err error) error {
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	}
+	return err
+}
 
-	// start cleaner
-	go conn.cleaner()
+// the iptables rules appended by this process, counted by the connections sharing them,
+// like the listeners on a port with Options.ReusePort
+var (
+	rulesLock sync.Mutex
+	rulesRefs = make(map[string]int)
+)
 
-	// iptables drop packets marked with TTL = 1
-	// TODO: what if iptables is not available, the next hop will send back ICMP Time Exceeded,
-	// is this still an acceptable behavior?
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4); err == nil {
-		rule := []string{"-m", "ttl", "--ttl-eq", "1", "-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.iprule = rule
-					conn.iptables = ipt
-				}
-			}
-		}
+// acquireRule appends rule to the OUTPUT chain if it doesn't exist, a rule appended by another
+// connection of this process is shared. owned reports whether the rule must be released by
+// releaseRule, exists whether the rule is in place.
+func acquireRule(ipt *iptables.IPTables, rule []string) (owned, exists bool) {
+	key := fmt.Sprint(ipt.Proto(), rule)
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	exists, err := ipt.Exists("filter", "OUTPUT", rule...)
+	if err != nil {
+		return false, false
 	}
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err == nil {
-		rule := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.ip6rule = rule
-					conn.ip6tables = ipt
-				}
-			}
+	if !exists {
+		if err := ipt.Append("filter", "OUTPUT", rule...); err != nil {
+			return false, false
 		}
+		rulesRefs[key] = 1
+		return true, true
 	}
+	if rulesRefs[key] > 0 {
+		rulesRefs[key]++
+		return true, true
+	}
+	return false, true
+}
 
-	// discard everything in original connection
-	go func() {
-		for {
-			tcpconn, err := l.AcceptTCP()
-			if err != nil {
-				return
-			}
-
-			// if we cannot set TTL = 1, the only thing reasonable is panic
-			if err := setTTL(tcpconn, 1); err != nil {
-				panic(err)
-			}
+// releaseRule deletes rule once the last connection sharing it releases it
+func releaseRule(ipt *iptables.IPTables, rule []string) {
+	key := fmt.Sprint(ipt.Proto(), rule)
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	if rulesRefs[key]--; rulesRefs[key] > 0 {
+		return
+	}
+	delete(rulesRefs, key)
+	ipt.Delete("filter", "OUTPUT", rule...)
+}
 
-			// record net.Conn
-			conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) { e.conn = tcpconn })
+// bindDevice returns a socket control function binding the socket to iface, or nil if iface is empty
+func bindDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	if iface == "" {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), iface)
+		})
+		return err
+	}
+}
 
-			// discard everything
-			go io.Copy(ioutil.Discard, tcpconn)
+// reusePort returns a socket control function setting SO_REUSEPORT, after ctrl if not nil
+func reusePort(ctrl func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if ctrl != nil {
+			if err := ctrl(network, address, c); err != nil {
+				return err
+			}
 		}
-	}()
-
-	return conn, nil
+		var err error
+		c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		return err
+	}
 }
 
 // setTTL sets the Time-To-Live field on a given connection
@@ -586,8 +3555,69 @@ func setTTL(c *net.TCPConn, ttl int) error {
 	return err
 }
 
-// setDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
-func setDSCP(c *net.IPConn, dscp int) error {
+// setHopLimit sets the Time-To-Live field in IPv4 header, or Hop Limit in IPv6 header.
+func setHopLimit(c *net.IPConn, ttl int) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	addr := c.LocalAddr().(*net.IPAddr)
+
+	if addr.IP.To4() == nil {
+		raw.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+		})
+	} else {
+		raw.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		})
+	}
+	return err
+}
+
+// setFragment clears the Don't Fragment flag of IPv4 packets, and lets the kernel fragment
+// IPv6 packets regardless of the path MTU, so oversized segments are fragmented by the IP stack
+func setFragment(c *net.IPConn) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if c.LocalAddr().(*net.IPAddr).IP.To4() != nil {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DONT)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setChecksumOffload has the kernel compute the TCP checksum of the segments sent on an IPv6
+// raw socket, at the offset of the checksum field, it has no effect on IPv4.
+func setChecksumOffload(c *net.IPConn) error {
+	if c.LocalAddr().(*net.IPAddr).IP.To4() != nil {
+		return nil
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_CHECKSUM, 16)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setTOS sets the 8bit Type of Service in IPv4 header, or Traffic Class in IPv6 header.
+func setTOS(c *net.IPConn, tos int) error {
 	raw, err := c.SyscallConn()
 	if err != nil {
 		return err
@@ -596,12 +3626,202 @@ func setDSCP(c *net.IPConn, dscp int) error {
 
 	if addr.IP.To4() == nil {
 		raw.Control(func(fd uintptr) {
-			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp)
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
 		})
 	} else {
 		raw.Control(func(fd uintptr) {
-			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
 		})
 	}
 	return err
 }
+
+// flow label manager of linux/in6.h, which golang's syscall package lacks
+const (
+	sysIPV6_FLOWINFO      = 0xb
+	sysIPV6_FLOWLABEL_MGR = 0x20
+	sysIPV6_FL_A_GET      = 0
+	sysIPV6_FL_A_PUT      = 1
+	sysIPV6_FL_F_CREATE   = 1
+	sysIPV6_FL_S_ANY      = 255
+)
+
+// in6FlowlabelReq is struct in6_flowlabel_req
+type in6FlowlabelReq struct {
+	dst     [16]byte
+	label   [4]byte // big endian
+	action  uint8
+	share   uint8
+	flags   uint16
+	expires uint16
+	linger  uint16
+	pad     uint32
+}
+
+// windowScales returns the window scales of the peer and ours negotiated by a system TCP connection,
+// tcpi_snd_wscale and tcpi_rcv_wscale of TCP_INFO, which are 0 unless both SYNs carry the option.
+// The fields are bitfields after tcpi_options, which x/sys/unix leaves in the padding of TCPInfo.
+func windowScales(c *net.TCPConn) (peer, local uint8, ok bool) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	raw.Control(func(fd uintptr) {
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err != nil {
+			return
+		}
+		wscale := *(*uint8)(unsafe.Pointer(uintptr(unsafe.Pointer(&info.Options)) + 1))
+		if littleEndian {
+			peer, local = wscale&0x0f, wscale>>4
+		} else {
+			peer, local = wscale>>4, wscale&0x0f
+		}
+		ok = true
+	})
+	return peer, local, ok
+}
+
+// littleEndian reports the byte order of the host, which lays out the bitfields of the kernel
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// setFlowLabel releases the lease of label old, and takes a lease of label fl on an IPv6 raw socket
+func setFlowLabel(c *net.IPConn, old, fl uint32) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	// the kernel refuses a lease without destination, while sending looks up the label
+	// alone, so the lease carries our own address and serves every peer
+	flowlabelMgr := func(fd uintptr, label uint32, action uint8, flags uint16) error {
+		req := in6FlowlabelReq{action: action, share: sysIPV6_FL_S_ANY, flags: flags}
+		copy(req.dst[:], c.LocalAddr().(*net.IPAddr).IP.To16())
+		binary.BigEndian.PutUint32(req.label[:], label)
+		b := (*[unsafe.Sizeof(req)]byte)(unsafe.Pointer(&req))
+		return os.NewSyscallError("setsockopt", syscall.SetsockoptString(int(fd), syscall.IPPROTO_IPV6, sysIPV6_FLOWLABEL_MGR, string(b[:])))
+	}
+
+	raw.Control(func(fd uintptr) {
+		if old != 0 {
+			flowlabelMgr(fd, old, sysIPV6_FL_A_PUT, 0)
+		}
+		if fl != 0 {
+			err = flowlabelMgr(fd, fl, sysIPV6_FL_A_GET, sysIPV6_FL_F_CREATE)
+		}
+	})
+	return err
+}
+
+// writeFlow sends b to raddr through an IPv6 raw socket, with the flow label in an IPV6_FLOWINFO control message
+func writeFlow(c *net.IPConn, b []byte, raddr *net.TCPAddr, fl uint32) (int, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	oob := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_IPV6
+	h.Type = sysIPV6_FLOWINFO
+	h.SetLen(syscall.CmsgLen(4))
+	binary.BigEndian.PutUint32(oob[syscall.CmsgLen(0):], fl)
+
+	var to syscall.Sockaddr
+	if c.RemoteAddr() == nil { // only unconnected sockets take a destination
+		sa := &syscall.SockaddrInet6{}
+		copy(sa.Addr[:], raddr.IP.To16())
+		if raddr.Zone != "" {
+			if ifi, err := net.InterfaceByName(raddr.Zone); err == nil {
+				sa.ZoneId = uint32(ifi.Index)
+			}
+		}
+		to = sa
+	}
+
+	var n int
+	werr := raw.Write(func(fd uintptr) bool {
+		n, err = syscall.SendmsgN(int(fd), b, oob, to, 0)
+		return err != syscall.EAGAIN
+	})
+	if werr != nil {
+		return 0, werr
+	}
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: "ip6", Source: c.LocalAddr(), Addr: &net.IPAddr{IP: raddr.IP, Zone: raddr.Zone}, Err: os.NewSyscallError("sendmsg", err)}
+	}
+	return n, nil
+}
+
+// rxqOverflow returns the drop counter in the SO_RXQ_OVFL control message of oob
+func rxqOverflow(oob []byte) (uint32, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SO_RXQ_OVFL && len(m.Data) >= 4 {
+			return *(*uint32)(unsafe.Pointer(&m.Data[0])), true
+		}
+	}
+	return 0, false
+}
+
+// setBPFPort attaches a socket filter which accepts only TCP segments to the given destination port,
+// the segments to the port are further filtered by extra if not empty
+func setBPFPort(c *net.IPConn, port int, extra []bpf.Instruction) error {
+	var filter []bpf.Instruction
+	if c.LocalAddr().(*net.IPAddr).IP.To4() != nil {
+		// IPv4 packets begin with IP header, skip it by IHL
+		filter = append(filter, bpf.LoadMemShift{Off: 0}, bpf.LoadIndirect{Off: 2, Size: 2})
+	} else {
+		filter = append(filter, bpf.LoadAbsolute{Off: 2, Size: 2})
+	}
+	filter = append(filter,
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(port), SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+	)
+	if len(extra) > 0 {
+		filter = append(filter, extra...)
+	} else {
+		filter = append(filter, bpf.RetConstant{Val: 0xffffffff})
+	}
+
+	raw, err := bpf.Assemble(filter)
+	if err != nil {
+		return err
+	}
+	return setBPF(c, toSockFilter(raw))
+}
+
+// toSockFilter converts assembled instructions to the form of setsockopt
+func toSockFilter(raw []bpf.RawInstruction) []syscall.SockFilter {
+	prog := make([]syscall.SockFilter, len(raw))
+	for k := range raw {
+		prog[k] = syscall.SockFilter{Code: raw[k].Op, Jt: raw[k].Jt, Jf: raw[k].Jf, K: raw[k].K}
+	}
+	return prog
+}
+
+// setBPF attaches a socket filter to the raw connection, a nil program detaches the current one.
+func setBPF(c *net.IPConn, prog []syscall.SockFilter) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	raw.Control(func(fd uintptr) {
+		if prog == nil {
+			err = syscall.DetachLsf(int(fd))
+			if err == syscall.ENOENT { // no filter attached
+				err = nil
+			}
+		} else {
+			err = syscall.AttachLsf(int(fd), prog)
+		}
+	})
+	return err
+}
@@ -3,18 +3,94 @@
 package tcpraw
 
 import (
+	"context"
 	"errors"
 	"net"
+	"time"
 )
 
 type TCPConn struct{ *net.UDPConn }
 
+var ErrMessageTooLong = errors.New("message too long")
+
+var ErrWouldBlock net.Error = wouldBlockError{}
+
+var ErrAddressLost = errors.New("local address is no longer assigned")
+
+func Available() (bool, error) {
+	return false, errors.New("os not supported")
+}
+
 // Dial connects to the remote TCP port,
 // and returns a single packet-oriented connection
 func Dial(network, address string) (*TCPConn, error) {
 	return nil, errors.New("os not supported")
 }
 
+func DialContext(ctx context.Context, network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func DialTimeout(network, address string, timeout time.Duration) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func DialFrom(network, localAddr, remoteAddr string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func DialWithOptions(network, address string, opts *Options) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func DialWithHandle(handle *net.IPConn, network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func DialOnInterface(network, address, iface string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func DialFD(fd int, network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
 func Listen(network, address string) (*TCPConn, error) {
 	return nil, errors.New("os not supported")
 }
+
+func ListenContext(ctx context.Context, network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func ListenWithOptions(network, address string, opts *Options) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func ListenOnInterface(network, address, iface string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func ListenWithHandle(handle *net.IPConn, network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func ListenRaw(network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func ListenFD(fds []int, network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func (d *Dialer) Dial(network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+func (lc *ListenConfig) Listen(ctx context.Context, network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}